@@ -0,0 +1,99 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestAESKeyWrapRoundTrip(t *testing.T) {
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := aesKeyWrap(kek, cek)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	unwrapped, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(cek, unwrapped) {
+		t.Fatal("unwrapped key does not match original")
+	}
+}
+
+func TestAESKeyWrapIntegrityCheckFailure(t *testing.T) {
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := aesKeyWrap(kek, cek)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	wrongKek := make([]byte, 32)
+	if _, err := rand.Read(wrongKek); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = aesKeyUnwrap(wrongKek, wrapped)
+	if !errors.Is(err, ErrKeyWrapIntegrityCheckFailed) {
+		t.Fatalf("expected ErrKeyWrapIntegrityCheckFailed, got %v", err)
+	}
+}
+
+func TestDecryptPBES2TruncatedGCMTag(t *testing.T) {
+	alg, ciphertext, err := encryptPBES2(rand.Reader, []byte("hello"), []byte("password"), EncryptOpts{
+		Algorithm:      PBES2_AES256_GCM_SHA256,
+		IterationCount: 1000,
+		SaltSize:       16,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	truncated := ciphertext[:gcmTagSize-1]
+	_, err = decryptPBES2(alg, truncated, []byte("password"))
+	if !errors.Is(err, ErrTruncatedGCMTag) {
+		t.Fatalf("expected ErrTruncatedGCMTag, got %v", err)
+	}
+}
+
+func TestDecryptPBES2GCMRoundTrip(t *testing.T) {
+	plaintext := []byte("the quick brown fox")
+	alg, ciphertext, err := encryptPBES2(rand.Reader, plaintext, []byte("password"), EncryptOpts{
+		Algorithm:      PBES2_AES256_GCM_SHA256,
+		IterationCount: 1000,
+		SaltSize:       16,
+	})
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	decrypted, err := decryptPBES2(alg, ciphertext, []byte("password"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(plaintext, decrypted) {
+		t.Fatal("decrypted plaintext does not match original")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+)
+
+// aesKeyWrapDefaultIV is the default initial value from RFC 3394 section
+// 2.2.3, used as an integrity check value: after unwrapping, the first 8
+// bytes of the result must equal this constant.
+var aesKeyWrapDefaultIV = [8]byte{0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6, 0xA6}
+
+// ErrKeyWrapIntegrityCheckFailed is returned by aesKeyUnwrap when the
+// unwrapped integrity check value does not match aesKeyWrapDefaultIV,
+// meaning the wrong KEK was used or the wrapped key was tampered with.
+var ErrKeyWrapIntegrityCheckFailed = errors.New("pkcs12: AES key wrap integrity check failed")
+
+// aesKeyWrap wraps cek with kek using the RFC 3394 AES Key Wrap algorithm.
+// len(cek) must be a multiple of 8 bytes and at least 16 bytes.
+func aesKeyWrap(kek, cek []byte) ([]byte, error) {
+	if len(cek)%8 != 0 || len(cek) < 16 {
+		return nil, errors.New("pkcs12: AES key wrap input must be a multiple of 8 bytes, at least 16")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, errors.New("pkcs12: error creating AES cipher for key wrap: " + err.Error())
+	}
+
+	n := len(cek) / 8
+	r := make([][8]byte, n)
+	for i := 0; i < n; i++ {
+		copy(r[i][:], cek[i*8:(i+1)*8])
+	}
+
+	var a [8]byte
+	copy(a[:], aesKeyWrapDefaultIV[:])
+
+	buf := make([]byte, 16)
+	for j := 0; j <= 5; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf[:8], a[:])
+			copy(buf[8:], r[i-1][:])
+			block.Encrypt(buf, buf)
+
+			t := uint64(n*j + i)
+			var tBytes [8]byte
+			binary.BigEndian.PutUint64(tBytes[:], t)
+			for k := 0; k < 8; k++ {
+				a[k] = buf[k] ^ tBytes[k]
+			}
+			copy(r[i-1][:], buf[8:])
+		}
+	}
+
+	out := make([]byte, 8+len(cek))
+	copy(out[:8], a[:])
+	for i := 0; i < n; i++ {
+		copy(out[8+i*8:8+(i+1)*8], r[i][:])
+	}
+	return out, nil
+}
+
+// aesKeyUnwrap unwraps wrapped with kek using the RFC 3394 AES Key Wrap
+// algorithm, returning ErrKeyWrapIntegrityCheckFailed if the integrity
+// check value doesn't match after unwrapping.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, errors.New("pkcs12: AES key wrap ciphertext must be a multiple of 8 bytes, at least 24")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, errors.New("pkcs12: error creating AES cipher for key unwrap: " + err.Error())
+	}
+
+	n := len(wrapped)/8 - 1
+	var a [8]byte
+	copy(a[:], wrapped[:8])
+
+	r := make([][8]byte, n)
+	for i := 0; i < n; i++ {
+		copy(r[i][:], wrapped[8+i*8:8+(i+1)*8])
+	}
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			var tBytes [8]byte
+			binary.BigEndian.PutUint64(tBytes[:], t)
+
+			var aXorT [8]byte
+			for k := 0; k < 8; k++ {
+				aXorT[k] = a[k] ^ tBytes[k]
+			}
+			copy(buf[:8], aXorT[:])
+			copy(buf[8:], r[i-1][:])
+			block.Decrypt(buf, buf)
+
+			copy(a[:], buf[:8])
+			copy(r[i-1][:], buf[8:])
+		}
+	}
+
+	if !constantTimeEqual(a[:], aesKeyWrapDefaultIV[:]) {
+		return nil, ErrKeyWrapIntegrityCheckFailed
+	}
+
+	cek := make([]byte, n*8)
+	for i := 0; i < n; i++ {
+		copy(cek[i*8:(i+1)*8], r[i][:])
+	}
+	return cek, nil
+}
+
+func constantTimeEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var v byte
+	for i := range a {
+		v |= a[i] ^ b[i]
+	}
+	return v == 0
+}
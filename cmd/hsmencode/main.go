@@ -0,0 +1,76 @@
+// Command hsmencode loads a certificate and a reference to a PKCS#11-backed
+// private key and emits a token-backed PKCS#12 file: the certificate is
+// embedded normally, but the private key bag only carries the token's
+// "pkcs11:" URI and CKA_ID, never the key material itself.
+//
+// The output is standards-compliant PKCS#12 and can be inspected with
+// `openssl pkcs12 -info -in out.p12 -nodes -passin pass:changeit`, but an
+// ordinary PKCS#12 consumer will not find a usable private key in it - only
+// a tool that understands the token-backed key bag, and has access to the
+// same PKCS#11 token, can use the key.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/colt3k/go-pkcs12"
+	"github.com/colt3k/go-pkcs12/hsm"
+)
+
+func main() {
+	certPath := flag.String("cert", "", "path to a PEM-encoded certificate")
+	module := flag.String("module", "/usr/local/lib/libykcs11.so", "path to the PKCS#11 module (e.g. libykcs11.so for YubiKey PIV)")
+	keyURI := flag.String("key-uri", "", `"pkcs11:" URI naming the private key object, e.g. pkcs11:token=YubiKey%20PIV;id=%01;type=private`)
+	out := flag.String("out", "out.p12", "output path for the token-backed PKCS#12 file")
+	password := flag.String("password", "changeit", "password protecting the PKCS#12 file")
+	flag.Parse()
+
+	if *certPath == "" || *keyURI == "" {
+		log.Fatal("usage: hsmencode -cert cert.pem -key-uri pkcs11:... [-module path] [-out out.p12] [-password pw]")
+	}
+
+	certPEM, err := os.ReadFile(*certPath)
+	if err != nil {
+		log.Fatalf("reading certificate: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		log.Fatalf("no PEM block found in %s", *certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Fatalf("parsing certificate: %v", err)
+	}
+
+	signer, err := hsm.NewSigner(hsm.ModuleOpener{ModulePath: *module}, *keyURI, cert.PublicKey)
+	if err != nil {
+		log.Fatalf("opening token-backed key: %v", err)
+	}
+	defer signer.Close()
+
+	uri, err := hsm.ParseURI(*keyURI)
+	if err != nil {
+		log.Fatalf("parsing key URI: %v", err)
+	}
+
+	builder := pkcs12.NewEncodeBuilder(rand.Reader, *password, pkcs12.DefaultEncryptOpts)
+	if err := builder.AddTokenBackedKey(signer, uri.ID, pkcs12.BagEntry{FriendlyName: cert.Subject.CommonName}); err != nil {
+		log.Fatalf("adding token-backed key: %v", err)
+	}
+	if err := builder.AddCertificate(cert, pkcs12.BagEntry{FriendlyName: cert.Subject.CommonName}); err != nil {
+		log.Fatalf("adding certificate: %v", err)
+	}
+
+	pfxData, err := builder.Finish()
+	if err != nil {
+		log.Fatalf("encoding PKCS#12 file: %v", err)
+	}
+	if err := os.WriteFile(*out, pfxData, 0600); err != nil {
+		log.Fatalf("writing %s: %v", *out, err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+)
+
+var (
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 1, 3})
+	oidPBEWithSHAAnd40BitRC2CBC      = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 12, 1, 6})
+)
+
+// encryptedPrivateKeyInfo mirrors the EncryptedPrivateKeyInfo SEQUENCE from
+// RFC 5208 section 6, carrying either a legacy PKCS#12 PBE
+// AlgorithmIdentifier (see pbeParams) or a PBES2 one (see pbes2Params).
+type encryptedPrivateKeyInfo struct {
+	AlgorithmIdentifier pkix.AlgorithmIdentifier
+	EncryptedData       []byte
+}
+
+// pbeParams is the PKCS-12PBEParams SEQUENCE from RFC 7292 appendix B.
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// pbeCipher is a block cipher keyed by the legacy PKCS#12 PBE scheme (RFC
+// 7292 appendix B.2), along with the key and IV sizes it expects.
+type pbeCipher interface {
+	create(key []byte) (cipher.Block, error)
+	keySize() int
+	blockSize() int
+}
+
+type shaWithTripleDESCBC struct{}
+
+func (shaWithTripleDESCBC) create(key []byte) (cipher.Block, error) {
+	return des.NewTripleDESCipher(key)
+}
+func (shaWithTripleDESCBC) keySize() int   { return 24 }
+func (shaWithTripleDESCBC) blockSize() int { return des.BlockSize }
+
+type shaWith40BitRC2CBC struct{}
+
+func (shaWith40BitRC2CBC) create(key []byte) (cipher.Block, error) {
+	return newRC2Cipher(key, len(key)*8)
+}
+func (shaWith40BitRC2CBC) keySize() int   { return 5 }
+func (shaWith40BitRC2CBC) blockSize() int { return rc2BlockSize }
+
+// pbeCipherFor returns the pbeCipher and parsed pbeParams for alg, or
+// NotImplementedError if alg identifies a scheme other than the two legacy
+// ones this package reads (3-key triple-DES and 40-bit RC2, both CBC).
+func pbeCipherFor(alg pkix.AlgorithmIdentifier) (pbeCipher, pbeParams, error) {
+	var c pbeCipher
+	switch {
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC):
+		c = shaWithTripleDESCBC{}
+	case alg.Algorithm.Equal(oidPBEWithSHAAnd40BitRC2CBC):
+		c = shaWith40BitRC2CBC{}
+	default:
+		return nil, pbeParams{}, NotImplementedError("algorithm " + alg.Algorithm.String() + " is not supported")
+	}
+
+	var params pbeParams
+	if err := unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, pbeParams{}, errors.New("pkcs12: error decoding PBE params: " + err.Error())
+	}
+	return c, params, nil
+}
+
+// pbDecrypt decrypts info.EncryptedData using the legacy PKCS#12 PBE scheme
+// (RFC 7292 appendix B) identified by info.AlgorithmIdentifier.
+func pbDecrypt(info *encryptedPrivateKeyInfo, password []byte) (decrypted []byte, err error) {
+	c, params, err := pbeCipherFor(info.AlgorithmIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := pkcs12KDF(sha1.New, password, params.Salt, 1, params.Iterations, c.keySize())
+	if err != nil {
+		return nil, err
+	}
+	iv, err := pkcs12KDF(sha1.New, password, params.Salt, 2, params.Iterations, c.blockSize())
+	if err != nil {
+		return nil, err
+	}
+	block, err := c.create(key)
+	if err != nil {
+		return nil, errors.New("pkcs12: error creating cipher: " + err.Error())
+	}
+
+	encrypted := info.EncryptedData
+	if len(encrypted) == 0 || len(encrypted)%block.BlockSize() != 0 {
+		return nil, errors.New("pkcs12: input is not a multiple of the block size")
+	}
+	decrypted = make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, encrypted)
+
+	if decrypted, err = pkcs7Unpad(decrypted, block.BlockSize()); err != nil {
+		return nil, ErrIncorrectPassword
+	}
+	return decrypted, nil
+}
+
+// pbEncrypt encrypts decrypted under the legacy PKCS#12 PBE scheme (RFC
+// 7292 appendix B) identified by info.AlgorithmIdentifier, which the caller
+// must already have populated (including its Salt/Iterations params),
+// filling in info.EncryptedData.
+func pbEncrypt(info *encryptedPrivateKeyInfo, decrypted, password []byte) error {
+	c, params, err := pbeCipherFor(info.AlgorithmIdentifier)
+	if err != nil {
+		return err
+	}
+
+	key, err := pkcs12KDF(sha1.New, password, params.Salt, 1, params.Iterations, c.keySize())
+	if err != nil {
+		return err
+	}
+	iv, err := pkcs12KDF(sha1.New, password, params.Salt, 2, params.Iterations, c.blockSize())
+	if err != nil {
+		return err
+	}
+	block, err := c.create(key)
+	if err != nil {
+		return errors.New("pkcs12: error creating cipher: " + err.Error())
+	}
+
+	encrypted := pkcs7Pad(decrypted, block.BlockSize())
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	info.EncryptedData = encrypted
+	return nil
+}
+
+// unmarshal calls asn1.Unmarshal, but also returns an error if there is any
+// trailing data after the marshaled value.
+func unmarshal(in []byte, out interface{}) error {
+	trailing, err := asn1.Unmarshal(in, out)
+	if err != nil {
+		return err
+	}
+	if len(trailing) != 0 {
+		return errors.New("pkcs12: trailing data found")
+	}
+	return nil
+}
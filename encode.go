@@ -0,0 +1,422 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+)
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 7, 1})
+	oidEncryptedDataContentType = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 7, 6})
+	oidFriendlyName             = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 20})
+	oidLocalKeyID               = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 21})
+	oidSHA1                     = asn1.ObjectIdentifier([]int{1, 3, 14, 3, 2, 26})
+	oidSHA256                   = asn1.ObjectIdentifier([]int{2, 16, 840, 1, 101, 3, 4, 2, 1})
+
+	// oidJavaTrustStore marks a certBag as a Java-style trusted certificate
+	// entry, so the resulting PKCS#12 file can be imported in place of a
+	// JKS keystore.
+	oidJavaTrustStore = asn1.ObjectIdentifier([]int{2, 16, 840, 1, 113894, 746875, 1, 1})
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type safeBag struct {
+	Id         asn1.ObjectIdentifier
+	Value      asn1.RawValue     `asn1:"tag:0,explicit"`
+	Attributes []pkcs12Attribute `asn1:"set,optional"`
+}
+
+type pkcs12Attribute struct {
+	Id     asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// BagEntry describes one key, certificate, CRL or secret to add to a PKCS#12
+// file via EncodeBuilder, together with the bag attributes PKCS#12 consumers
+// commonly look for.
+type BagEntry struct {
+	// FriendlyName is stored as the bag's friendlyName attribute, if set.
+	FriendlyName string
+	// LocalKeyID is stored as the bag's localKeyId attribute, if set. It is
+	// conventionally used to associate a certificate with the private key
+	// it belongs to.
+	LocalKeyID []byte
+}
+
+// EncodeBuilder assembles a PKCS#12 file from an arbitrary combination of
+// keys, certificates, CRLs and secrets. Encode and EncodeTrustStore are
+// convenience wrappers around the common cases; use EncodeBuilder directly
+// for anything else, such as multiple keys or certificates, or the
+// friendlyName/localKeyId attributes examples and tooling expect.
+type EncodeBuilder struct {
+	rand       io.Reader
+	password   []byte
+	opts       EncryptOpts
+	keyBags    []safeBag
+	certBags   []safeBag
+	crlBags    []safeBag
+	secretBags []safeBag
+}
+
+// NewEncodeBuilder creates an EncodeBuilder that encrypts its SafeContents
+// and shrouded keys under password using opts.
+func NewEncodeBuilder(rand io.Reader, password string, opts EncryptOpts) *EncodeBuilder {
+	return &EncodeBuilder{rand: rand, password: []byte(password), opts: opts}
+}
+
+func bagAttributes(entry BagEntry) ([]pkcs12Attribute, error) {
+	var attrs []pkcs12Attribute
+	if entry.FriendlyName != "" {
+		v, err := asn1.MarshalWithParams(entry.FriendlyName, "bmpString")
+		if err != nil {
+			return nil, errors.New("pkcs12: error encoding friendlyName: " + err.Error())
+		}
+		attrs = append(attrs, pkcs12Attribute{Id: oidFriendlyName, Values: []asn1.RawValue{{FullBytes: v}}})
+	}
+	if len(entry.LocalKeyID) > 0 {
+		v, err := asn1.Marshal(entry.LocalKeyID)
+		if err != nil {
+			return nil, errors.New("pkcs12: error encoding localKeyId: " + err.Error())
+		}
+		attrs = append(attrs, pkcs12Attribute{Id: oidLocalKeyID, Values: []asn1.RawValue{{FullBytes: v}}})
+	}
+	return attrs, nil
+}
+
+// AddShroudedKey adds privateKey as a PKCS#8 shrouded key bag, encrypted
+// under the builder's password.
+func (b *EncodeBuilder) AddShroudedKey(privateKey interface{}, entry BagEntry) error {
+	attrs, err := bagAttributes(entry)
+	if err != nil {
+		return err
+	}
+	bagData, err := encodePkcs8ShroudedKeyBag(b.rand, privateKey, b.password, b.opts)
+	if err != nil {
+		return errors.New("pkcs12: error encoding shrouded key bag: " + err.Error())
+	}
+	b.keyBags = append(b.keyBags, safeBag{
+		Id:         oidPKCS8ShroundedKeyBag,
+		Value:      asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: bagData},
+		Attributes: attrs,
+	})
+	return nil
+}
+
+// AddCertificate adds cert as an X.509 certBag.
+func (b *EncodeBuilder) AddCertificate(cert *x509.Certificate, entry BagEntry) error {
+	return b.addCertBag(cert.Raw, entry, nil)
+}
+
+// AddTrustedCertificate adds cert as a Java-style trusted certificate entry
+// (oidJavaTrustStore), so the resulting file can be imported in place of a
+// JKS keystore.
+func (b *EncodeBuilder) AddTrustedCertificate(cert *x509.Certificate, entry BagEntry) error {
+	return b.addCertBag(cert.Raw, entry, oidJavaTrustStore)
+}
+
+func (b *EncodeBuilder) addCertBag(der []byte, entry BagEntry, trustOID asn1.ObjectIdentifier) error {
+	attrs, err := bagAttributes(entry)
+	if err != nil {
+		return err
+	}
+	bagData, err := encodeCertBag(der)
+	if err != nil {
+		return errors.New("pkcs12: error encoding cert bag: " + err.Error())
+	}
+	if trustOID != nil {
+		attrs = append(attrs, pkcs12Attribute{Id: trustOID, Values: []asn1.RawValue{{FullBytes: []byte{asn1.TagNull, 0}}}})
+	}
+	b.certBags = append(b.certBags, safeBag{
+		Id:         oidCertBag,
+		Value:      asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: bagData},
+		Attributes: attrs,
+	})
+	return nil
+}
+
+// AddCRL adds crl as a crlBag.
+func (b *EncodeBuilder) AddCRL(crl *pkix.CertificateList, entry BagEntry) error {
+	attrs, err := bagAttributes(entry)
+	if err != nil {
+		return err
+	}
+	bagData, err := encodeCrlBag(crl)
+	if err != nil {
+		return errors.New("pkcs12: error encoding crl bag: " + err.Error())
+	}
+	b.crlBags = append(b.crlBags, safeBag{
+		Id:         oidCrlBag,
+		Value:      asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: bagData},
+		Attributes: attrs,
+	})
+	return nil
+}
+
+// AddSecret adds secretData as a secretBag, such as the client secrets
+// ClientSecret in example/main.go reads back out by friendlyName.
+func (b *EncodeBuilder) AddSecret(secretData []byte, entry BagEntry) error {
+	attrs, err := bagAttributes(entry)
+	if err != nil {
+		return err
+	}
+	bagData, err := encodeSecretBag(secretData)
+	if err != nil {
+		return errors.New("pkcs12: error encoding secret bag: " + err.Error())
+	}
+	b.secretBags = append(b.secretBags, safeBag{
+		Id:         oidSecretBag,
+		Value:      asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: bagData},
+		Attributes: attrs,
+	})
+	return nil
+}
+
+// encodeSafeContentsPlain marshals bags as a plaintext SafeContents wrapped
+// in a "data" ContentInfo.
+func encodeSafeContentsPlain(bags []safeBag) (contentInfo, error) {
+	safeContentsData, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, errors.New("pkcs12: error encoding safe contents: " + err.Error())
+	}
+	// Data ::= OCTET STRING (RFC 2315 section 8): the content of a "data"
+	// ContentInfo is the SafeContents DER wrapped in an OCTET STRING, not
+	// the SafeContents DER itself.
+	octetString, err := asn1.Marshal(safeContentsData)
+	if err != nil {
+		return contentInfo{}, errors.New("pkcs12: error encoding safe contents: " + err.Error())
+	}
+	return contentInfo{
+		ContentType: oidDataContentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: octetString},
+	}, nil
+}
+
+// encodeSafeContentsEncrypted marshals bags as a SafeContents and wraps it
+// in a password-encrypted "encryptedData" ContentInfo, using the same
+// EncryptionAlgorithm chosen for shrouded keys.
+func (b *EncodeBuilder) encodeSafeContentsEncrypted(rand io.Reader, bags []safeBag) (contentInfo, error) {
+	safeContentsData, err := asn1.Marshal(bags)
+	if err != nil {
+		return contentInfo{}, errors.New("pkcs12: error encoding safe contents: " + err.Error())
+	}
+
+	var ed encryptedData
+	ed.Version = 0
+	ed.EncryptedContentInfo.ContentType = oidDataContentType
+
+	if isPBES2Algorithm(b.opts.Algorithm) {
+		alg, ciphertext, err := encryptPBES2(rand, safeContentsData, b.password, b.opts)
+		if err != nil {
+			return contentInfo{}, errors.New("pkcs12: error encrypting safe contents: " + err.Error())
+		}
+		ed.EncryptedContentInfo.ContentEncryptionAlgorithm = alg
+		ed.EncryptedContentInfo.EncryptedContent = ciphertext
+	} else {
+		if b.opts.Algorithm != PBEWithSHAAnd3KeyTripleDESCBC {
+			return contentInfo{}, errors.New("pkcs12: EncryptOpts.Algorithm is not valid for an encrypted SafeContents")
+		}
+		randomSalt := make([]byte, 8)
+		if _, err := io.ReadFull(rand, randomSalt); err != nil {
+			return contentInfo{}, errors.New("pkcs12: error reading random salt: " + err.Error())
+		}
+		paramBytes, err := asn1.Marshal(pbeParams{Salt: randomSalt, Iterations: 2048})
+		if err != nil {
+			return contentInfo{}, errors.New("pkcs12: error encoding params: " + err.Error())
+		}
+		ed.EncryptedContentInfo.ContentEncryptionAlgorithm = pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyTripleDESCBC,
+			Parameters: asn1.RawValue{FullBytes: paramBytes},
+		}
+		pkinfo := encryptedPrivateKeyInfo{AlgorithmIdentifier: ed.EncryptedContentInfo.ContentEncryptionAlgorithm}
+		if err := pbEncrypt(&pkinfo, safeContentsData, b.password); err != nil {
+			return contentInfo{}, errors.New("pkcs12: error encrypting safe contents: " + err.Error())
+		}
+		ed.EncryptedContentInfo.EncryptedContent = pkinfo.EncryptedData
+	}
+
+	edData, err := asn1.Marshal(ed)
+	if err != nil {
+		return contentInfo{}, errors.New("pkcs12: error encoding encrypted data: " + err.Error())
+	}
+	return contentInfo{
+		ContentType: oidEncryptedDataContentType,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: edData},
+	}, nil
+}
+
+// macDigestAlgorithm returns the digest OID used for MacData, matching the
+// caller's choice of EncryptionAlgorithm: OpenSSL 3's "-macalg sha256"
+// default for PBES2, and the legacy SHA-1 MAC otherwise.
+func (b *EncodeBuilder) macDigestAlgorithm() asn1.ObjectIdentifier {
+	if isPBES2Algorithm(b.opts.Algorithm) {
+		return oidSHA256
+	}
+	return oidSHA1
+}
+
+func (b *EncodeBuilder) computeMac(authSafeData []byte, salt []byte, iterations int) ([]byte, error) {
+	if isPBES2Algorithm(b.opts.Algorithm) {
+		key, err := pkcs12KDF(sha256.New, b.password, salt, 3, iterations, sha256.Size)
+		if err != nil {
+			return nil, err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(authSafeData)
+		return mac.Sum(nil), nil
+	}
+	key, err := pkcs12KDF(sha1.New, b.password, salt, 3, iterations, sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, key)
+	mac.Write(authSafeData)
+	return mac.Sum(nil), nil
+}
+
+// Finish assembles every bag added so far into a PFX: a PKCS#8-shrouded
+// SafeContents for keys, a password-encrypted SafeContents for certificates,
+// CRLs and secrets, and a MacData computed with HMAC-SHA-256 when PBES2 is
+// in use (matching OpenSSL 3's "-macalg sha256" default).
+func (b *EncodeBuilder) Finish() (pfxData []byte, err error) {
+	var authSafeContents []contentInfo
+
+	if len(b.keyBags) > 0 {
+		ci, err := encodeSafeContentsPlain(b.keyBags)
+		if err != nil {
+			return nil, err
+		}
+		authSafeContents = append(authSafeContents, ci)
+	}
+
+	var other []safeBag
+	other = append(other, b.certBags...)
+	other = append(other, b.crlBags...)
+	other = append(other, b.secretBags...)
+	if len(other) > 0 {
+		ci, err := b.encodeSafeContentsEncrypted(b.rand, other)
+		if err != nil {
+			return nil, err
+		}
+		authSafeContents = append(authSafeContents, ci)
+	}
+
+	authSafeData, err := asn1.Marshal(authSafeContents)
+	if err != nil {
+		return nil, errors.New("pkcs12: error encoding authenticated safe: " + err.Error())
+	}
+	// As with encodeSafeContentsPlain, the PFX's "data" ContentInfo content
+	// is the AuthenticatedSafe DER wrapped in an OCTET STRING.
+	authSafeOctetString, err := asn1.Marshal(authSafeData)
+	if err != nil {
+		return nil, errors.New("pkcs12: error encoding authenticated safe: " + err.Error())
+	}
+
+	var pfx pfxPdu
+	pfx.Version = 3
+	pfx.AuthSafe.ContentType = oidDataContentType
+	pfx.AuthSafe.Content = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: authSafeOctetString}
+
+	salt := make([]byte, 8)
+	if _, err := io.ReadFull(b.rand, salt); err != nil {
+		return nil, errors.New("pkcs12: error reading random MAC salt: " + err.Error())
+	}
+	iterations := 2048
+	if b.opts.IterationCount > 0 {
+		iterations = b.opts.IterationCount
+	}
+
+	macAlg := b.macDigestAlgorithm()
+	digest, err := b.computeMac(authSafeData, salt, iterations)
+	if err != nil {
+		return nil, errors.New("pkcs12: error computing MAC: " + err.Error())
+	}
+
+	pfx.MacData = macData{
+		Mac: digestInfo{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: macAlg, Parameters: asn1.RawValue{Tag: asn1.TagNull}},
+			Digest:    digest,
+		},
+		MacSalt:    salt,
+		Iterations: iterations,
+	}
+
+	if pfxData, err = asn1.Marshal(pfx); err != nil {
+		return nil, errors.New("pkcs12: error encoding PFX: " + err.Error())
+	}
+	return pfxData, nil
+}
+
+// Encode builds a password-protected PKCS#12 file containing privateKey,
+// certificate and, optionally, caCerts, using DefaultEncryptOpts. The
+// result round-trips through ToPEM.
+func Encode(rand io.Reader, privateKey interface{}, certificate *x509.Certificate, caCerts []*x509.Certificate, password string) ([]byte, error) {
+	b := NewEncodeBuilder(rand, password, DefaultEncryptOpts)
+	if err := b.AddShroudedKey(privateKey, BagEntry{}); err != nil {
+		return nil, err
+	}
+	if err := b.AddCertificate(certificate, BagEntry{}); err != nil {
+		return nil, err
+	}
+	for _, caCert := range caCerts {
+		if err := b.AddCertificate(caCert, BagEntry{}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// EncodeTrustStore builds a password-protected PKCS#12 file containing only
+// certificates, marked with the Java trusted-certificate attribute so the
+// result can be imported in place of a JKS keystore.
+func EncodeTrustStore(rand io.Reader, certs []*x509.Certificate, password string) ([]byte, error) {
+	b := NewEncodeBuilder(rand, password, DefaultEncryptOpts)
+	for _, cert := range certs {
+		if err := b.AddTrustedCertificate(cert, BagEntry{FriendlyName: cert.Subject.CommonName}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
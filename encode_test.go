@@ -0,0 +1,73 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func generateTestCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+func TestEncodeDecodeRoundTripPBES2(t *testing.T) {
+	key, cert := generateTestCert(t)
+
+	data, err := Encode(rand.Reader, key, cert, nil, "changeit")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, _, err := Decode(data, "changeit"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
+
+// TestEncodeDecodeRoundTripLegacy exercises PBEWithSHAAnd3KeyTripleDESCBC,
+// the zero value of EncryptOpts.Algorithm, to guard against computeMac
+// rejecting it instead of writing the legacy SHA-1 MAC.
+func TestEncodeDecodeRoundTripLegacy(t *testing.T) {
+	key, cert := generateTestCert(t)
+
+	b := NewEncodeBuilder(rand.Reader, "changeit", EncryptOpts{})
+	if err := b.AddShroudedKey(key, BagEntry{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if err := b.AddCertificate(cert, BagEntry{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	data, err := b.Finish()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, _, err := Decode(data, "changeit"); err != nil {
+		t.Fatalf("%+v", err)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import "errors"
+
+// ErrIncorrectPassword is returned when an incorrect password is detected.
+// Usually, P12/PFX data is signed to be able to verify the password.
+var ErrIncorrectPassword = errors.New("pkcs12: decryption password incorrect")
+
+// NotImplementedError indicates that the input PFX data uses an algorithm
+// or feature that this package does not implement.
+type NotImplementedError string
+
+func (e NotImplementedError) Error() string {
+	return "pkcs12: " + string(e)
+}
@@ -0,0 +1,268 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hsm implements crypto.Signer and crypto.Decrypter on top of a
+// PKCS#11 session, so a PKCS#12 file's private key can stay on a token
+// (a YubiKey PIV slot via libykcs11, a SoftHSM slot, or any other PKCS#11
+// module) instead of ever being materialized in Go memory.
+package hsm
+
+import (
+	"crypto"
+	"errors"
+	"io"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Opener opens a PKCS#11 session against a slot identified by a "pkcs11:"
+// URI and returns it ready for use (initialized and, if the URI carries a
+// PIN, logged in). Callers supply an Opener so the session lifecycle -
+// which module to load, which slot to pick when a URI is ambiguous, how to
+// prompt for a PIN - stays outside this package.
+type Opener interface {
+	Open(uri *URI) (*Session, error)
+}
+
+// Session wraps an open PKCS#11 session. Callers obtain one from an Opener
+// and must call Close when done with it.
+type Session struct {
+	Ctx    *pkcs11.Ctx
+	Handle pkcs11.SessionHandle
+}
+
+// Close logs out of and closes the session, but does not finalize or
+// destroy the underlying Ctx, which an Opener may share across sessions.
+func (s *Session) Close() error {
+	_ = s.Ctx.Logout(s.Handle)
+	return s.Ctx.CloseSession(s.Handle)
+}
+
+// ModuleOpener is the straightforward Opener: it loads a PKCS#11 module,
+// opens a read-only session against the slot named by the URI (by slot-id
+// if present, otherwise the slot whose token label matches the URI's token
+// attribute, or the first slot with a token present if there is none), and
+// logs in with the URI's pin-value if one was supplied.
+type ModuleOpener struct {
+	// ModulePath is the shared library to load, e.g.
+	// "/usr/local/lib/libykcs11.so" for YubiKey PIV or the path to
+	// libsofthsm2.so for SoftHSM.
+	ModulePath string
+}
+
+func (o ModuleOpener) Open(uri *URI) (*Session, error) {
+	ctx := pkcs11.New(o.ModulePath)
+	if ctx == nil {
+		return nil, errors.New("hsm: failed to load PKCS#11 module " + o.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, errors.New("hsm: error initializing PKCS#11 module: " + err.Error())
+	}
+
+	slotID, err := resolveSlot(ctx, uri)
+	if err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	handle, err := ctx.OpenSession(slotID, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		ctx.Destroy()
+		return nil, errors.New("hsm: error opening PKCS#11 session: " + err.Error())
+	}
+
+	if uri.PINValue != "" {
+		if err := ctx.Login(handle, pkcs11.CKU_USER, uri.PINValue); err != nil {
+			ctx.CloseSession(handle)
+			ctx.Destroy()
+			return nil, errors.New("hsm: error logging in to token: " + err.Error())
+		}
+	}
+
+	return &Session{Ctx: ctx, Handle: handle}, nil
+}
+
+func resolveSlot(ctx *pkcs11.Ctx, uri *URI) (uint, error) {
+	if uri.SlotID != nil {
+		return *uri.SlotID, nil
+	}
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, errors.New("hsm: error listing PKCS#11 slots: " + err.Error())
+	}
+	if uri.Token == "" {
+		if len(slots) == 0 {
+			return 0, errors.New("hsm: no PKCS#11 slots with a token present")
+		}
+		return slots[0], nil
+	}
+	for _, slotID := range slots {
+		info, err := ctx.GetTokenInfo(slotID)
+		if err != nil {
+			continue
+		}
+		if info.Label == uri.Token {
+			return slotID, nil
+		}
+	}
+	return 0, errors.New("hsm: no slot found for token label " + uri.Token)
+}
+
+// Signer is a crypto.Signer and crypto.Decrypter backed by a private key
+// object on a PKCS#11 token. Its private material never leaves the token:
+// every Sign/Decrypt call is forwarded to the HSM as a C_Sign/C_Decrypt
+// operation against the object found by CKA_ID.
+type Signer struct {
+	session *Session
+	uri     *URI
+	object  pkcs11.ObjectHandle
+	public  crypto.PublicKey
+}
+
+// NewSigner opens uri (a "pkcs11:" URI naming a private key object, e.g.
+// "pkcs11:token=YubiKey%20PIV;id=%01;type=private") via opener, locates the
+// CKA_ID it names, and returns a Signer backed by that object.
+func NewSigner(opener Opener, rawURI string, public crypto.PublicKey) (*Signer, error) {
+	uri, err := ParseURI(rawURI)
+	if err != nil {
+		return nil, err
+	}
+	session, err := opener.Open(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := findObject(session, uri, pkcs11.CKO_PRIVATE_KEY)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	return &Signer{session: session, uri: uri, object: object, public: public}, nil
+}
+
+func findObject(session *Session, uri *URI, class uint) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, class)}
+	if len(uri.ID) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, uri.ID))
+	}
+	if uri.Object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, uri.Object))
+	}
+
+	if err := session.Ctx.FindObjectsInit(session.Handle, template); err != nil {
+		return 0, errors.New("hsm: error starting object search: " + err.Error())
+	}
+	defer session.Ctx.FindObjectsFinal(session.Handle)
+
+	objects, _, err := session.Ctx.FindObjects(session.Handle, 1)
+	if err != nil {
+		return 0, errors.New("hsm: error searching for object: " + err.Error())
+	}
+	if len(objects) == 0 {
+		return 0, errors.New("hsm: no object found matching " + uri.String())
+	}
+	return objects[0], nil
+}
+
+// Public returns the signer's public key, as supplied to NewSigner (the
+// public half of a token-backed key is ordinarily read from the
+// accompanying certificate rather than from the token).
+func (s *Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// URI returns the "pkcs11:" URI identifying this key's token and object, for
+// embedding in a token-backed PKCS#12 SecretBag.
+func (s *Signer) URI() string {
+	return s.uri.String()
+}
+
+// Close releases the underlying PKCS#11 session.
+func (s *Signer) Close() error {
+	return s.session.Close()
+}
+
+// Sign performs a C_Sign operation on the token using the CKM_RSA_PKCS
+// mechanism (RSASSA-PKCS1-v1_5 over a pre-computed digest). digest is
+// prefixed with the DER DigestInfo header for opts.HashFunc(), which must be
+// SHA-256, SHA-384 or SHA-512. RSA-PSS and EC/Ed25519 keys are not
+// supported.
+func (s *Signer) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var prefix []byte
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		prefix = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+	case crypto.SHA384:
+		prefix = []byte{0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30}
+	case crypto.SHA512:
+		prefix = []byte{0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40}
+	default:
+		return nil, errors.New("hsm: unsupported hash function for RSA signing")
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, errors.New("hsm: digest length does not match hash function")
+	}
+
+	mechanism := pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+	if err := s.session.Ctx.SignInit(s.session.Handle, []*pkcs11.Mechanism{mechanism}, s.object); err != nil {
+		return nil, errors.New("hsm: error starting sign operation: " + err.Error())
+	}
+	return s.session.Ctx.Sign(s.session.Handle, append(prefix, digest...))
+}
+
+// Decrypt performs a C_Decrypt operation on the token using the
+// CKM_RSA_PKCS mechanism (PKCS#1 v1.5 padding). opts is unused for now;
+// OAEP is not yet supported.
+func (s *Signer) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	mechanism := pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)
+	if err := s.session.Ctx.DecryptInit(s.session.Handle, []*pkcs11.Mechanism{mechanism}, s.object); err != nil {
+		return nil, errors.New("hsm: error starting decrypt operation: " + err.Error())
+	}
+	return s.session.Ctx.Decrypt(s.session.Handle, ciphertext)
+}
+
+// UnwrapPKCS8ShroudedKey unwraps wrappedKey (a PBES2/AES-CBC-encrypted
+// PKCS#8 PrivateKeyInfo) via C_UnwrapKey, using the secret-key object named
+// by kekURI's id and object attributes as the unwrapping key. The unwrapped
+// key is imported as a new, sensitive, non-extractable private key session
+// object (CKA_TOKEN false) and never leaves the HSM; the returned handle is
+// a "pkcs11:" URI for that new object. This
+// method satisfies the pkcs12.KEKUnwrapper interface without importing the
+// pkcs12 package, so callers wire it in as:
+//
+//	pkcs12.DecodePkcs8ShroudedKeyBagWithHSM(asn1Data, kekURI, session)
+func (s *Session) UnwrapPKCS8ShroudedKey(kekURI string, wrappedKey []byte) (keyHandle string, err error) {
+	uri, err := ParseURI(kekURI)
+	if err != nil {
+		return "", err
+	}
+
+	kek, err := findObject(s, uri, pkcs11.CKO_SECRET_KEY)
+	if err != nil {
+		return "", err
+	}
+
+	mechanism := pkcs11.NewMechanism(pkcs11.CKM_AES_CBC_PAD, make([]byte, 16))
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+	}
+
+	object, err := s.Ctx.UnwrapKey(s.Handle, []*pkcs11.Mechanism{mechanism}, kek, wrappedKey, template)
+	if err != nil {
+		return "", errors.New("hsm: error unwrapping shrouded key: " + err.Error())
+	}
+
+	idAttr, err := s.Ctx.GetAttributeValue(s.Handle, object, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, nil)})
+	if err != nil {
+		return "", errors.New("hsm: error reading unwrapped key's CKA_ID: " + err.Error())
+	}
+
+	return (&URI{Token: uri.Token, ID: idAttr[0].Value, Type: "private"}).String(), nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URI is a parsed "pkcs11:" URI, covering the subset of RFC 7512 this
+// package needs to locate a slot, token and object: the module-local
+// path attributes (token, manufacturer, serial, id, object, type) and the
+// module-local query attributes (pin-value, pin-source, slot-id).
+type URI struct {
+	Token        string
+	Manufacturer string
+	Serial       string
+	Object       string
+	Type         string // "public", "private", "cert" or "secret-key"
+	ID           []byte
+
+	SlotID   *uint
+	PINValue string
+	PINPath  string
+}
+
+// ParseURI parses a "pkcs11:" URI as defined by RFC 7512.
+func ParseURI(raw string) (*URI, error) {
+	const scheme = "pkcs11:"
+	if !strings.HasPrefix(raw, scheme) {
+		return nil, errors.New("hsm: not a pkcs11: URI")
+	}
+	rest := raw[len(scheme):]
+
+	path := rest
+	query := ""
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		path = rest[:i]
+		query = rest[i+1:]
+	}
+
+	u := &URI{}
+	for _, seg := range strings.Split(path, ";") {
+		if seg == "" {
+			continue
+		}
+		k, v, err := splitAttr(seg)
+		if err != nil {
+			return nil, err
+		}
+		switch k {
+		case "token":
+			u.Token = v
+		case "manufacturer":
+			u.Manufacturer = v
+		case "serial":
+			u.Serial = v
+		case "object":
+			u.Object = v
+		case "type":
+			u.Type = v
+		case "id":
+			u.ID = []byte(v)
+		}
+	}
+
+	for _, seg := range strings.Split(query, "&") {
+		if seg == "" {
+			continue
+		}
+		k, v, err := splitAttr(seg)
+		if err != nil {
+			return nil, err
+		}
+		switch k {
+		case "pin-value":
+			u.PINValue = v
+		case "pin-source":
+			u.PINPath = v
+		case "slot-id":
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return nil, errors.New("hsm: invalid slot-id attribute: " + err.Error())
+			}
+			slotID := uint(n)
+			u.SlotID = &slotID
+		}
+	}
+
+	return u, nil
+}
+
+func splitAttr(seg string) (key, value string, err error) {
+	i := strings.IndexByte(seg, '=')
+	if i < 0 {
+		return "", "", errors.New("hsm: malformed pkcs11 URI attribute: " + seg)
+	}
+	value, err = url.PathUnescape(seg[i+1:])
+	if err != nil {
+		return "", "", errors.New("hsm: invalid percent-encoding in URI attribute: " + err.Error())
+	}
+	return seg[:i], value, nil
+}
+
+// String renders u back into a "pkcs11:" URI. It is the inverse of ParseURI
+// for the attributes this package sets.
+func (u *URI) String() string {
+	var path []string
+	if u.Token != "" {
+		path = append(path, "token="+url.PathEscape(u.Token))
+	}
+	if u.Object != "" {
+		path = append(path, "object="+url.PathEscape(u.Object))
+	}
+	if u.Type != "" {
+		path = append(path, "type="+u.Type)
+	}
+	if len(u.ID) > 0 {
+		path = append(path, "id="+url.PathEscape(string(u.ID)))
+	}
+	return "pkcs11:" + strings.Join(path, ";")
+}
@@ -0,0 +1,22 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package hsm
+
+import "testing"
+
+// TestParseURIIDNotDoubleUnescaped guards against re-applying
+// url.PathUnescape to an already-decoded id attribute, which would corrupt
+// any CKA_ID whose decoded bytes contain a literal '%' followed by two
+// hex-like characters.
+func TestParseURIIDNotDoubleUnescaped(t *testing.T) {
+	u, err := ParseURI("pkcs11:id=%2541")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if string(u.ID) != "%41" {
+		t.Fatalf("ID = %q, want %q", u.ID, "%41")
+	}
+}
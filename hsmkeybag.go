@@ -0,0 +1,157 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+)
+
+// oidTokenBackedKey marks a secretBag as a reference to a private key that
+// stays on a PKCS#11 token, rather than a PKCS#8 shrouded key bag carrying
+// the key material itself.
+var oidTokenBackedKey = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 999, 1})
+
+// tokenKeyRef is the payload of a token-backed secretBag: the CKA_ID of the
+// key object and the "pkcs11:" URI (RFC 7512) of the slot it lives on.
+type tokenKeyRef struct {
+	SlotURI string
+	CKAID   []byte
+}
+
+// decodeTokenKeyRef decodes a token-backed secretBag's raw bytes (as found
+// in safeBag.Value.Bytes) into the tokenKeyRef it carries. It returns
+// NotImplementedError if the secretBag's type is not oidSecretBag; it does
+// not check that the bag is a token-backed key reference, which callers
+// decide from the bag's attributes via hasTokenBackedKeyAttribute.
+func decodeTokenKeyRef(asn1Data []byte) (tokenKeyRef, error) {
+	var bag secretBag
+	if err := unmarshal(asn1Data, &bag); err != nil {
+		return tokenKeyRef{}, errors.New("pkcs12: error decoding secret bag: " + err.Error())
+	}
+	if !bag.Id.Equal(oidSecretBag) {
+		return tokenKeyRef{}, NotImplementedError("secret bag is not a token key reference")
+	}
+
+	var ref tokenKeyRef
+	if err := unmarshal(bag.Data, &ref); err != nil {
+		return tokenKeyRef{}, errors.New("pkcs12: error decoding token key reference: " + err.Error())
+	}
+	return ref, nil
+}
+
+// hasTokenBackedKeyAttribute reports whether attrs marks its bag as a
+// token-backed key reference via oidTokenBackedKey.
+func hasTokenBackedKeyAttribute(attrs []pkcs12Attribute) bool {
+	for _, attr := range attrs {
+		if attr.Id.Equal(oidTokenBackedKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenSigner is implemented by a key that stays on a PKCS#11 token, such as
+// *hsm.Signer. AddTokenBackedKey only needs the object's CKA_ID and the
+// "pkcs11:" URI of the slot it lives on, not a live session.
+type TokenSigner interface {
+	URI() string
+}
+
+// AddTokenBackedKey adds a reference to a token-backed private key instead
+// of a shrouded key bag: a secretBag carrying the key's CKA_ID and slot URI
+// (RFC 7512). The resulting PKCS#12 file never contains key material; a
+// consumer that understands oidTokenBackedKey re-derives the key by opening
+// the referenced PKCS#11 slot, so this is not a drop-in replacement for a
+// shrouded key bag in generic PKCS#12 tooling.
+func (b *EncodeBuilder) AddTokenBackedKey(signer TokenSigner, ckaID []byte, entry BagEntry) error {
+	attrs, err := bagAttributes(entry)
+	if err != nil {
+		return err
+	}
+
+	refData, err := asn1.Marshal(tokenKeyRef{SlotURI: signer.URI(), CKAID: ckaID})
+	if err != nil {
+		return errors.New("pkcs12: error encoding token key reference: " + err.Error())
+	}
+	bagData, err := encodeSecretBag(refData)
+	if err != nil {
+		return errors.New("pkcs12: error encoding token key reference bag: " + err.Error())
+	}
+
+	b.keyBags = append(b.keyBags, safeBag{
+		Id:         oidSecretBag,
+		Value:      asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: bagData},
+		Attributes: append(attrs, pkcs12Attribute{Id: oidTokenBackedKey, Values: []asn1.RawValue{{FullBytes: []byte{asn1.TagNull, 0}}}}),
+	})
+	return nil
+}
+
+// KEKUnwrapper unwraps a PKCS#8 shrouded key inside an HSM via C_UnwrapKey,
+// using a key-encryption key referenced by a "pkcs11:" URI, so the
+// unwrapped private key never needs to be materialized in Go memory.
+// Implementations live outside this package (see pkcs12/hsm.Session) since
+// they depend on a live PKCS#11 session.
+type KEKUnwrapper interface {
+	// UnwrapPKCS8ShroudedKey unwraps the AES-CBC/PBES2-encrypted PKCS#8
+	// key wrappedKey using the KEK identified by kekURI, and returns a
+	// handle string (e.g. a further "pkcs11:" URI for the now-imported
+	// private key object) rather than the key material itself.
+	UnwrapPKCS8ShroudedKey(kekURI string, wrappedKey []byte) (keyHandle string, err error)
+}
+
+// kekURIPrefix marks a password value as a "pkcs11:" KEK reference rather
+// than a literal PKCS#12 password.
+const kekURIPrefix = "pkcs11:"
+
+// DecodePkcs8ShroudedKeyBagWithHSM decodes a PKCS#8 shrouded key bag whose
+// password field is a "pkcs11:" URI (RFC 7512) naming a KEK object, by
+// unwrapping it inside the HSM via unwrapper instead of deriving a
+// PBE/PBES2 key in Go and decrypting locally. It returns the handle
+// unwrapper produces for the now-imported key, never the key material.
+func DecodePkcs8ShroudedKeyBagWithHSM(asn1Data []byte, password string, unwrapper KEKUnwrapper) (keyHandle string, err error) {
+	if len(password) < len(kekURIPrefix) || password[:len(kekURIPrefix)] != kekURIPrefix {
+		return "", errors.New("pkcs12: password is not a pkcs11: KEK URI")
+	}
+
+	pkinfo := new(encryptedPrivateKeyInfo)
+	if err := unmarshal(asn1Data, pkinfo); err != nil {
+		return "", errors.New("pkcs12: error decoding PKCS#8 shrouded key bag: " + err.Error())
+	}
+	if !isPBES2(pkinfo.AlgorithmIdentifier) {
+		return "", NotImplementedError("HSM-side unwrap is only supported for PBES2-encrypted shrouded key bags")
+	}
+
+	return unwrapper.UnwrapPKCS8ShroudedKey(password, pkinfo.EncryptedData)
+}
+
+// ToPEMWithHSM is ToPEM for a PFX whose password is a "pkcs11:" KEK URI: it
+// decodes certBags, keyBags and secretBags exactly as ToPEM does, but any
+// PKCS#8 shrouded key bag is unwrapped inside the HSM via
+// DecodePkcs8ShroudedKeyBagWithHSM instead of being decrypted in Go, so the
+// private key material is never read into Go memory. That bag is emitted
+// as a "PKCS11 KEY HANDLE" block whose Bytes are the handle string
+// unwrapper returns for the now-imported key.
+//
+// This requires password to serve double duty: the same "pkcs11:" URI is
+// both the PFX's real MacData/SafeContents password and the KEK reference
+// passed to unwrapper, so a file intended for HSM-side unwrapping must have
+// been produced with that URI as its password in the first place.
+func ToPEMWithHSM(pfxData []byte, password string, unwrapper KEKUnwrapper) ([]*pem.Block, error) {
+	bags, _, err := getSafeContents(pfxData, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	return bagsToPEM(bags, func(bag safeBag) (*pem.Block, error) {
+		keyHandle, err := DecodePkcs8ShroudedKeyBagWithHSM(bag.Value.Bytes, password, unwrapper)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PKCS11 KEY HANDLE", Headers: make(map[string]string), Bytes: []byte(keyHandle)}, nil
+	})
+}
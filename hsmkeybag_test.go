@@ -0,0 +1,136 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// fakeTokenSigner is a TokenSigner backed by a fixed URI, standing in for
+// *hsm.Signer in tests that don't need a live PKCS#11 session.
+type fakeTokenSigner string
+
+func (s fakeTokenSigner) URI() string { return string(s) }
+
+func TestToPEMSurfacesTokenBackedKey(t *testing.T) {
+	ckaID := []byte{0x01, 0x02, 0x03}
+
+	builder := NewEncodeBuilder(rand.Reader, "changeit", DefaultEncryptOpts)
+	if err := builder.AddTokenBackedKey(fakeTokenSigner("pkcs11:token=test;object=key1"), ckaID, BagEntry{FriendlyName: "token-key-1"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	pfxData, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	blocks, err := ToPEM(pfxData, "changeit")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(blocks) != 1 {
+		t.Fatalf("got %d PEM blocks, want 1", len(blocks))
+	}
+
+	block := blocks[0]
+	if block.Type != "PKCS11 KEY REFERENCE" {
+		t.Fatalf("block type = %q, want %q", block.Type, "PKCS11 KEY REFERENCE")
+	}
+	if got, want := block.Headers["slotURI"], "pkcs11:token=test;object=key1"; got != want {
+		t.Fatalf("slotURI header = %q, want %q", got, want)
+	}
+	if got, want := block.Headers["ckaId"], "010203"; got != want {
+		t.Fatalf("ckaId header = %q, want %q", got, want)
+	}
+	if got, want := block.Headers["tokenBackedKey"], "true"; got != want {
+		t.Fatalf("tokenBackedKey header = %q, want %q", got, want)
+	}
+	if got, want := block.Headers["friendlyName"], "token-key-1"; got != want {
+		t.Fatalf("friendlyName header = %q, want %q", got, want)
+	}
+}
+
+// fakeKEKUnwrapper stands in for a live PKCS#11 session in tests: instead of
+// calling C_UnwrapKey, it just records the KEK URI and wrapped key it was
+// given and returns a fixed handle.
+type fakeKEKUnwrapper struct {
+	gotKekURI     string
+	gotWrappedKey []byte
+	keyHandle     string
+}
+
+func (u *fakeKEKUnwrapper) UnwrapPKCS8ShroudedKey(kekURI string, wrappedKey []byte) (string, error) {
+	u.gotKekURI = kekURI
+	u.gotWrappedKey = wrappedKey
+	return u.keyHandle, nil
+}
+
+func TestToPEMWithHSMUnwrapsShroudedKey(t *testing.T) {
+	const kekURI = "pkcs11:token=test;object=kek1"
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "hsm-unwrap-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pfxData, err := Encode(rand.Reader, priv, cert, nil, kekURI)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	unwrapper := &fakeKEKUnwrapper{keyHandle: "pkcs11:token=test;object=imported-key1"}
+	blocks, err := ToPEMWithHSM(pfxData, kekURI, unwrapper)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	var keyBlock, certBlock *pem.Block
+	for _, block := range blocks {
+		switch block.Type {
+		case "PKCS11 KEY HANDLE":
+			keyBlock = block
+		case "CERTIFICATE":
+			certBlock = block
+		}
+	}
+	if keyBlock == nil {
+		t.Fatal("no PKCS11 KEY HANDLE block in result")
+	}
+	if certBlock == nil {
+		t.Fatal("no CERTIFICATE block in result")
+	}
+	if got, want := string(keyBlock.Bytes), unwrapper.keyHandle; got != want {
+		t.Fatalf("key handle = %q, want %q", got, want)
+	}
+	if unwrapper.gotKekURI != kekURI {
+		t.Fatalf("unwrapper saw KEK URI %q, want %q", unwrapper.gotKekURI, kekURI)
+	}
+	if len(unwrapper.gotWrappedKey) == 0 {
+		t.Fatal("unwrapper was not given the wrapped key bytes")
+	}
+}
@@ -0,0 +1,301 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// EncryptionAlgorithm identifies the password-based encryption scheme used to
+// protect a shrouded key bag (or other encrypted SafeContents) in a PKCS#12
+// file.
+type EncryptionAlgorithm int
+
+const (
+	// PBEWithSHAAnd3KeyTripleDESCBC is the legacy PKCS#12 PBE scheme
+	// (RFC 7292 appendix B) written by OpenSSL 1.x and older Java
+	// keystores. This is the only scheme earlier versions of this package
+	// could write or read.
+	PBEWithSHAAnd3KeyTripleDESCBC EncryptionAlgorithm = iota
+
+	// PBES2_AES256_SHA256 is PBES2 (RFC 8018 section 6.2) with
+	// PBKDF2-HMAC-SHA256 key derivation and AES-256-CBC encryption. This
+	// is the scheme OpenSSL 3 and modern Java keystores default to.
+	PBES2_AES256_SHA256
+
+	// PBES2_AES256_GCM_SHA256 is PBES2 with PBKDF2-HMAC-SHA256 key
+	// derivation and AES-256-GCM encryption (RFC 8018 section 6.2, with
+	// the GCM encryption scheme from RFC 5084). It is accepted by macOS
+	// Keychain and Windows CNG.
+	PBES2_AES256_GCM_SHA256
+
+	// AESKeyWrap256 names RFC 3394 AES Key Wrap with a 256-bit
+	// key-encryption key. It is not a valid EncryptOpts value: no
+	// SafeContents is wrapped with it, and AddShroudedKey and the
+	// encryption of certificate, CRL and secret SafeContents return an
+	// error for it. KEK-wrapped secretBag contents are written by
+	// EncodeBuilder.AddKEKWrappedSecret, which takes its KEK directly and
+	// does not read EncryptOpts.
+	AESKeyWrap256
+)
+
+// EncryptOpts controls how a password-encrypted SafeContents (such as a
+// PKCS#8 shrouded key bag) is protected when a PKCS#12 file is written. The
+// zero value selects the legacy PBEWithSHAAnd3KeyTripleDESCBC scheme; use
+// DefaultEncryptOpts or set Algorithm explicitly for PBES2.
+type EncryptOpts struct {
+	// Algorithm selects the encryption scheme.
+	Algorithm EncryptionAlgorithm
+
+	// IterationCount is the number of key-derivation iterations. When
+	// Algorithm is PBEWithSHAAnd3KeyTripleDESCBC, shrouded keys and
+	// encrypted SafeContents always use the legacy fixed count of 2048;
+	// EncodeBuilder.Finish still uses IterationCount (2048 if zero) for
+	// the MacData.
+	IterationCount int
+
+	// SaltSize is the length in bytes of the random salt used for PBES2
+	// key derivation. If zero, a 16-byte salt is used. The legacy scheme
+	// and the MacData always use an 8-byte salt.
+	SaltSize int
+}
+
+// DefaultEncryptOpts are the options used by Encode when none are supplied.
+// They match OpenSSL 3's defaults: PBES2 with PBKDF2-HMAC-SHA256 and
+// AES-256-CBC, 100,000 iterations and a 16-byte salt.
+var DefaultEncryptOpts = EncryptOpts{
+	Algorithm:      PBES2_AES256_SHA256,
+	IterationCount: 100000,
+	SaltSize:       16,
+}
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 5, 13})
+	oidPBKDF2         = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 5, 12})
+	oidAES256CBC      = asn1.ObjectIdentifier([]int{2, 16, 840, 1, 101, 3, 4, 1, 42})
+	oidAES256GCM      = asn1.ObjectIdentifier([]int{2, 16, 840, 1, 101, 3, 4, 1, 46})
+	oidHMACWithSHA256 = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 2, 9})
+)
+
+// gcmTagSize is the GCM authentication tag size this package always uses,
+// the full 16-byte AES-GCM tag. RFC 5084's default ICVlen is 12, so
+// encryptPBES2 writes the tag size explicitly in GCMParameters; decryptPBES2
+// always uses 16 bytes and does not read ICVlen.
+const gcmTagSize = 16
+
+// gcmParameters is the GCMParameters SEQUENCE from RFC 5084 section 3.2.
+type gcmParameters struct {
+	Nonce  []byte
+	ICVlen int `asn1:"optional,default:12"`
+}
+
+// pbes2Params is the PBES2-params SEQUENCE from RFC 8018 section 6.2.
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params is the PBKDF2-params SEQUENCE from RFC 8018 section 5.2. PRF
+// is optional; when absent it defaults to HMAC-SHA1, but this package always
+// writes it explicitly as HMAC-SHA256.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// isPBES2 reports whether alg identifies a PBES2 AlgorithmIdentifier.
+func isPBES2(alg pkix.AlgorithmIdentifier) bool {
+	return alg.Algorithm.Equal(oidPBES2)
+}
+
+// isPBES2Algorithm reports whether alg selects one of the PBES2-based
+// EncryptionAlgorithm values (as opposed to the legacy PBE scheme or the
+// KEK-wrapped AESKeyWrap256, which isn't password-based at all).
+func isPBES2Algorithm(alg EncryptionAlgorithm) bool {
+	return alg == PBES2_AES256_SHA256 || alg == PBES2_AES256_GCM_SHA256
+}
+
+// encryptPBES2 encrypts data under a key derived from password via
+// PBKDF2-HMAC-SHA256, using AES-256-CBC or AES-256-GCM depending on
+// opts.Algorithm, and returns the AlgorithmIdentifier and ciphertext to
+// embed in an encryptedPrivateKeyInfo (or other
+// EncryptedData/EncryptedContentInfo).
+func encryptPBES2(rand io.Reader, data, password []byte, opts EncryptOpts) (alg pkix.AlgorithmIdentifier, ciphertext []byte, err error) {
+	saltSize := opts.SaltSize
+	if saltSize == 0 {
+		saltSize = 16
+	}
+	salt := make([]byte, saltSize)
+	if _, err = io.ReadFull(rand, salt); err != nil {
+		return alg, nil, errors.New("pkcs12: error reading random salt: " + err.Error())
+	}
+
+	key := pbkdf2.Key(password, salt, opts.IterationCount, 32, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return alg, nil, errors.New("pkcs12: error creating AES cipher: " + err.Error())
+	}
+
+	var encScheme pkix.AlgorithmIdentifier
+	switch opts.Algorithm {
+	case PBES2_AES256_GCM_SHA256:
+		nonce := make([]byte, 12)
+		if _, err = io.ReadFull(rand, nonce); err != nil {
+			return alg, nil, errors.New("pkcs12: error reading random nonce: " + err.Error())
+		}
+		gcm, err := cipher.NewGCMWithTagSize(block, gcmTagSize)
+		if err != nil {
+			return alg, nil, errors.New("pkcs12: error creating GCM cipher: " + err.Error())
+		}
+		ciphertext = gcm.Seal(nil, nonce, data, nil)
+
+		paramBytes, err := asn1.Marshal(gcmParameters{Nonce: nonce, ICVlen: gcmTagSize})
+		if err != nil {
+			return alg, nil, errors.New("pkcs12: error encoding GCM params: " + err.Error())
+		}
+		encScheme = pkix.AlgorithmIdentifier{Algorithm: oidAES256GCM, Parameters: asn1.RawValue{FullBytes: paramBytes}}
+
+	default:
+		iv := make([]byte, aes.BlockSize)
+		if _, err = io.ReadFull(rand, iv); err != nil {
+			return alg, nil, errors.New("pkcs12: error reading random IV: " + err.Error())
+		}
+		ciphertext = pkcs7Pad(data, block.BlockSize())
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+		ivBytes, err := asn1.Marshal(iv)
+		if err != nil {
+			return alg, nil, errors.New("pkcs12: error encoding AES-CBC IV: " + err.Error())
+		}
+		encScheme = pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivBytes}}
+	}
+
+	kdfParamBytes, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: opts.IterationCount,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.RawValue{Tag: asn1.TagNull}},
+	})
+	if err != nil {
+		return alg, nil, errors.New("pkcs12: error encoding PBKDF2 params: " + err.Error())
+	}
+
+	params := pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdfParamBytes}},
+		EncryptionScheme:  encScheme,
+	}
+	paramBytes, err := asn1.Marshal(params)
+	if err != nil {
+		return alg, nil, errors.New("pkcs12: error encoding PBES2 params: " + err.Error())
+	}
+
+	alg = pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: paramBytes}}
+	return alg, ciphertext, nil
+}
+
+// ErrTruncatedGCMTag is returned by decryptPBES2 when a GCM-encrypted
+// SafeContents is shorter than the authentication tag it must carry, which
+// is distinguished from a failed tag check so truncation and tampering are
+// not reported identically.
+var ErrTruncatedGCMTag = errors.New("pkcs12: GCM ciphertext is shorter than the authentication tag")
+
+// decryptPBES2 decrypts ciphertext using the PBES2 parameters in alg.
+// Only PBKDF2 key derivation is supported, with AES-256-CBC or AES-256-GCM
+// encryption, covering the schemes this package writes and the defaults
+// used by OpenSSL 3, macOS Keychain and modern Java keystores.
+func decryptPBES2(alg pkix.AlgorithmIdentifier, ciphertext, password []byte) ([]byte, error) {
+	var params pbes2Params
+	if err := unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.New("pkcs12: error decoding PBES2 params: " + err.Error())
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, NotImplementedError("only PBKDF2 key derivation is supported for PBES2")
+	}
+
+	var kdfParams pbkdf2Params
+	if err := unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdfParams); err != nil {
+		return nil, errors.New("pkcs12: error decoding PBKDF2 params: " + err.Error())
+	}
+	key := pbkdf2.Key(password, kdfParams.Salt, kdfParams.IterationCount, 32, sha256.New)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("pkcs12: error creating AES cipher: " + err.Error())
+	}
+
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256GCM):
+		var gcmParams gcmParameters
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &gcmParams); err != nil {
+			return nil, errors.New("pkcs12: error decoding GCM params: " + err.Error())
+		}
+		if len(ciphertext) < gcmTagSize {
+			return nil, ErrTruncatedGCMTag
+		}
+		gcm, err := cipher.NewGCMWithTagSize(block, gcmTagSize)
+		if err != nil {
+			return nil, errors.New("pkcs12: error creating GCM cipher: " + err.Error())
+		}
+		plaintext, err := gcm.Open(nil, gcmParams.Nonce, ciphertext, nil)
+		if err != nil {
+			return nil, errors.New("pkcs12: GCM authentication failed: " + err.Error())
+		}
+		return plaintext, nil
+
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		var iv []byte
+		if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+			return nil, errors.New("pkcs12: error decoding AES-CBC IV: " + err.Error())
+		}
+		if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+			return nil, errors.New("pkcs12: PBES2 ciphertext is not a multiple of the block size")
+		}
+		plaintext := make([]byte, len(ciphertext))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+		return pkcs7Unpad(plaintext, block.BlockSize())
+
+	default:
+		return nil, NotImplementedError("only AES-256-CBC and AES-256-GCM are supported as PBES2 encryption schemes")
+	}
+}
+
+// pkcs7Pad pads data to a multiple of blockSize using PKCS#7 padding.
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padLen := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data)+padLen)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(padLen)
+	}
+	return padded
+}
+
+// pkcs7Unpad removes and validates PKCS#7 padding.
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	if len(data) == 0 || len(data)%blockSize != 0 {
+		return nil, errors.New("pkcs12: invalid padded data length")
+	}
+	padLen := int(data[len(data)-1])
+	if padLen == 0 || padLen > blockSize || padLen > len(data) {
+		return nil, errors.New("pkcs12: invalid padding")
+	}
+	for _, b := range data[len(data)-padLen:] {
+		if int(b) != padLen {
+			return nil, errors.New("pkcs12: invalid padding")
+		}
+	}
+	return data[:len(data)-padLen], nil
+}
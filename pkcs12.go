@@ -0,0 +1,336 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package pkcs12 implements some of PKCS#12.
+//
+// This implementation is distilled from https://tools.ietf.org/html/rfc7292
+// and various PKCS#12 libraries in common use. It is intended for
+// compatibility with the default settings of OpenSSL and OpenSSL 3, and
+// with Java's keytool.
+package pkcs12
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+)
+
+// Decode extracts a certificate and private key from pfxData. This function
+// assumes that there is only one private key and only one certificate in
+// the pfxData; it returns an error if more than one of either is present.
+func Decode(pfxData []byte, password string) (privateKey interface{}, certificate *x509.Certificate, err error) {
+	bags, pw, err := getSafeContents(pfxData, []byte(password))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, bag := range bags {
+		switch {
+		case bag.Id.Equal(oidKeyBag):
+			if privateKey != nil {
+				return nil, nil, errors.New("pkcs12: expected exactly one key bag")
+			}
+			if privateKey, err = decodePkcs8KeyBag(bag.Value.Bytes); err != nil {
+				return nil, nil, err
+			}
+
+		case bag.Id.Equal(oidPKCS8ShroundedKeyBag):
+			if privateKey != nil {
+				return nil, nil, errors.New("pkcs12: expected exactly one key bag")
+			}
+			if privateKey, err = decodePkcs8ShroudedKeyBag(bag.Value.Bytes, pw); err != nil {
+				return nil, nil, err
+			}
+
+		case bag.Id.Equal(oidCertBag):
+			certsData, err := decodeCertBag(bag.Value.Bytes)
+			if err != nil {
+				return nil, nil, err
+			}
+			certs, err := x509.ParseCertificates(certsData)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(certs) != 1 {
+				return nil, nil, errors.New("pkcs12: expected exactly one certificate in the certBag")
+			}
+			if certificate != nil {
+				return nil, nil, errors.New("pkcs12: expected exactly one certificate bag")
+			}
+			certificate = certs[0]
+		}
+	}
+
+	if certificate == nil {
+		return nil, nil, errors.New("pkcs12: certificate missing")
+	}
+	if privateKey == nil {
+		return nil, nil, errors.New("pkcs12: private key missing")
+	}
+
+	return privateKey, certificate, nil
+}
+
+// ToPEM converts all the private keys, certificates, and secrets in pfxData
+// into PEM blocks, using password to decrypt whatever SafeContents require
+// it. Each bag's friendlyName/localKeyId attributes, if present, are stored
+// as PEM headers so a caller can correlate blocks belonging to the same
+// entry, as ClientSecret in example/main.go does. A secretBag added via
+// EncodeBuilder.AddTokenBackedKey is emitted as a "PKCS11 KEY REFERENCE"
+// block carrying its slotURI/ckaId headers rather than a generic,
+// unlabeled "SECRET BAG", since it never contains key material.
+func ToPEM(pfxData []byte, password string) ([]*pem.Block, error) {
+	bags, pw, err := getSafeContents(pfxData, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	return bagsToPEM(bags, func(bag safeBag) (*pem.Block, error) {
+		key, err := decodePkcs8ShroudedKeyBag(bag.Value.Bytes, pw)
+		if err != nil {
+			return nil, err
+		}
+		keyData, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, errors.New("pkcs12: error encoding private key: " + err.Error())
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Headers: make(map[string]string), Bytes: keyData}, nil
+	})
+}
+
+// bagsToPEM converts bags into PEM blocks, sharing the cert/key/secret-bag
+// handling common to ToPEM and ToPEMWithHSM. shroudedKey decodes an
+// oidPKCS8ShroundedKeyBag's raw bytes into the PEM block the two exported
+// functions differ on: a PRIVATE KEY block for ToPEM, a PKCS11 KEY HANDLE
+// block for ToPEMWithHSM.
+func bagsToPEM(bags []safeBag, shroudedKey func(bag safeBag) (*pem.Block, error)) ([]*pem.Block, error) {
+	blocks := make([]*pem.Block, 0, len(bags))
+	for _, bag := range bags {
+		var block *pem.Block
+		var err error
+
+		switch {
+		case bag.Id.Equal(oidCertBag):
+			certsData, err := decodeCertBag(bag.Value.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			block = &pem.Block{Type: "CERTIFICATE", Headers: make(map[string]string), Bytes: certsData}
+
+		case bag.Id.Equal(oidKeyBag):
+			key, err := decodePkcs8KeyBag(bag.Value.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keyData, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return nil, errors.New("pkcs12: error encoding private key: " + err.Error())
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Headers: make(map[string]string), Bytes: keyData}
+
+		case bag.Id.Equal(oidPKCS8ShroundedKeyBag):
+			if block, err = shroudedKey(bag); err != nil {
+				return nil, err
+			}
+
+		case bag.Id.Equal(oidSecretBag) && hasTokenBackedKeyAttribute(bag.Attributes):
+			ref, err := decodeTokenKeyRef(bag.Value.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			block = &pem.Block{
+				Type:    "PKCS11 KEY REFERENCE",
+				Headers: map[string]string{"slotURI": ref.SlotURI, "ckaId": hex.EncodeToString(ref.CKAID)},
+				Bytes:   nil,
+			}
+
+		case bag.Id.Equal(oidSecretBag):
+			secretData, err := decodeSecretBag(bag.Value.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			block = &pem.Block{Type: "SECRET BAG", Headers: make(map[string]string), Bytes: secretData}
+
+		default:
+			continue
+		}
+
+		for _, attribute := range bag.Attributes {
+			k, v, err := convertAttribute(&attribute)
+			if err != nil {
+				// Attributes this package doesn't recognize are skipped
+				// rather than treated as fatal, matching the lenient
+				// attitude consumers like keytool take.
+				continue
+			}
+			block.Headers[k] = v
+		}
+
+		blocks = append(blocks, block)
+	}
+
+	return blocks, nil
+}
+
+// getSafeContents parses pfxData as a PFX (RFC 7292 section 4), verifies
+// its MacData against password and returns the safeBags of every
+// SafeContents in its authenticated safe.
+func getSafeContents(p12Data, password []byte) (bags []safeBag, updatedPassword []byte, err error) {
+	pfx := new(pfxPdu)
+	if err := unmarshal(p12Data, pfx); err != nil {
+		return nil, nil, errors.New("pkcs12: error reading P12 data: " + err.Error())
+	}
+
+	if pfx.Version != 3 {
+		return nil, nil, NotImplementedError("can only decode v3 PFX PDUs")
+	}
+
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, nil, NotImplementedError("only password-protected PFX is implemented")
+	}
+
+	var authenticatedSafe []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authenticatedSafe); err != nil {
+		return nil, nil, errors.New("pkcs12: error reading auth safe: " + err.Error())
+	}
+
+	if len(pfx.MacData.Mac.Algorithm.Algorithm) == 0 {
+		return nil, nil, errors.New("pkcs12: no MAC in data")
+	}
+
+	if err := verifyMac(&pfx.MacData, authenticatedSafe, password); err != nil {
+		return nil, nil, err
+	}
+
+	var authSafeContents []contentInfo
+	if err := unmarshal(authenticatedSafe, &authSafeContents); err != nil {
+		return nil, nil, errors.New("pkcs12: error reading auth safe contents: " + err.Error())
+	}
+
+	for _, ci := range authSafeContents {
+		var bagsData []byte
+
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			if err := unmarshal(ci.Content.Bytes, &bagsData); err != nil {
+				return nil, nil, errors.New("pkcs12: error reading data content: " + err.Error())
+			}
+
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var ed encryptedData
+			if err := unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, errors.New("pkcs12: error reading encrypted data content: " + err.Error())
+			}
+			if ed.Version != 0 {
+				return nil, nil, NotImplementedError("only version 0 of EncryptedData is supported")
+			}
+
+			alg := ed.EncryptedContentInfo.ContentEncryptionAlgorithm
+			if isPBES2(alg) {
+				if bagsData, err = decryptPBES2(alg, ed.EncryptedContentInfo.EncryptedContent, password); err != nil {
+					return nil, nil, err
+				}
+			} else {
+				pkinfo := &encryptedPrivateKeyInfo{
+					AlgorithmIdentifier: alg,
+					EncryptedData:       ed.EncryptedContentInfo.EncryptedContent,
+				}
+				if bagsData, err = pbDecrypt(pkinfo, password); err != nil {
+					return nil, nil, err
+				}
+			}
+
+		default:
+			return nil, nil, NotImplementedError("only data and encryptedData content types are supported in authenticated safe")
+		}
+
+		var safeContents []safeBag
+		if err := unmarshal(bagsData, &safeContents); err != nil {
+			return nil, nil, errors.New("pkcs12: error reading safe contents: " + err.Error())
+		}
+		bags = append(bags, safeContents...)
+	}
+
+	return bags, password, nil
+}
+
+// verifyMac checks macData.Mac against an HMAC of message keyed by the
+// integrity key pkcs12KDF derives from password and macData.MacSalt. It
+// accepts the legacy SHA-1 MAC and the HMAC-SHA256 MAC, the latter named in
+// MacData.Mac.Algorithm either by the SHA-256 digest OID, which this package
+// writes for PBES2-protected files as OpenSSL 3 does, or by the
+// hmacWithSHA256 OID.
+func verifyMac(macData *macData, message, password []byte) error {
+	switch {
+	case macData.Mac.Algorithm.Algorithm.Equal(oidSHA1):
+		key, err := pkcs12KDF(sha1.New, password, macData.MacSalt, 3, macData.Iterations, sha1.Size)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(sha1.New, key)
+		mac.Write(message)
+		if !hmac.Equal(mac.Sum(nil), macData.Mac.Digest) {
+			return ErrIncorrectPassword
+		}
+		return nil
+
+	case macData.Mac.Algorithm.Algorithm.Equal(oidHMACWithSHA256), macData.Mac.Algorithm.Algorithm.Equal(oidSHA256):
+		key, err := pkcs12KDF(sha256.New, password, macData.MacSalt, 3, macData.Iterations, sha256.Size)
+		if err != nil {
+			return err
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(message)
+		if !hmac.Equal(mac.Sum(nil), macData.Mac.Digest) {
+			return ErrIncorrectPassword
+		}
+		return nil
+
+	default:
+		return NotImplementedError("unknown digest algorithm: " + macData.Mac.Algorithm.Algorithm.String())
+	}
+}
+
+// convertAttribute turns a bag attribute this package recognizes into a PEM
+// header key/value pair, as used by ToPEM.
+func convertAttribute(attribute *pkcs12Attribute) (key, value string, err error) {
+	isString := false
+
+	switch {
+	case attribute.Id.Equal(oidFriendlyName):
+		key = "friendlyName"
+		isString = true
+	case attribute.Id.Equal(oidLocalKeyID):
+		key = "localKeyId"
+	case attribute.Id.Equal(oidJavaTrustStore):
+		return "javaTrustStore", "true", nil
+	case attribute.Id.Equal(oidTokenBackedKey):
+		return "tokenBackedKey", "true", nil
+	default:
+		return "", "", NotImplementedError("attribute type not implemented: " + attribute.Id.String())
+	}
+
+	if len(attribute.Values) != 1 {
+		return "", "", NotImplementedError("attribute values must contain exactly one value")
+	}
+
+	if isString {
+		if _, err := asn1.UnmarshalWithParams(attribute.Values[0].FullBytes, &value, "bmpString"); err != nil {
+			return "", "", errors.New("pkcs12: error decoding friendlyName: " + err.Error())
+		}
+		return key, value, nil
+	}
+
+	var id []byte
+	if err := unmarshal(attribute.Values[0].FullBytes, &id); err != nil {
+		return "", "", errors.New("pkcs12: error decoding " + key + ": " + err.Error())
+	}
+	return key, hex.EncodeToString(id), nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// pkcs12KDF implements the PKCS#12 key-derivation function from RFC 7292
+// appendix B.2. It is used both to derive the legacy PBE key/IV (id 1/2)
+// and, regardless of which content-encryption scheme a SafeContents uses,
+// to derive the integrity key for the MacData at the end of the PFX (id 3).
+//
+//	id=1: key material for encryption/decryption
+//	id=2: an IV for encryption/decryption
+//	id=3: an integrity key for MACing
+func pkcs12KDF(newHash func() hash.Hash, password, salt []byte, id byte, iterations, size int) ([]byte, error) {
+	h := newHash()
+	u := h.Size()
+	v := h.BlockSize()
+
+	bmpPassword, err := bmpStringZeroTerminated(password)
+	if err != nil {
+		return nil, err
+	}
+
+	// D: a diversifier, v bytes long, all bytes equal to id.
+	D := bytes.Repeat([]byte{id}, v)
+
+	// S: salt, concatenated to a multiple of v bytes.
+	S := fillWithRepeats(salt, v)
+	// P: password, concatenated to a multiple of v bytes.
+	P := fillWithRepeats(bmpPassword, v)
+
+	I := append(S, P...)
+
+	c := (size + u - 1) / u
+	A := make([]byte, c*u)
+	for i := 0; i < c; i++ {
+		h = newHash()
+		h.Write(D)
+		h.Write(I)
+		Ai := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			h = newHash()
+			h.Write(Ai)
+			Ai = h.Sum(nil)
+		}
+		copy(A[i*u:(i+1)*u], Ai)
+
+		if i != c-1 {
+			// B: Ai repeated to fill v bytes.
+			B := fillWithRepeats(Ai, v)
+
+			// Treat I as a sequence of v-byte blocks and add B, mod 2^(v*8),
+			// to each block.
+			for j := 0; j < len(I)/v; j++ {
+				addOne(I[j*v:(j+1)*v], B)
+			}
+		}
+	}
+
+	return A[:size], nil
+}
+
+// fillWithRepeats returns a slice that repeats pattern enough times to reach
+// the next multiple of v (at least v bytes), or an empty slice if pattern is
+// empty.
+func fillWithRepeats(pattern []byte, v int) []byte {
+	if len(pattern) == 0 {
+		return []byte{}
+	}
+	n := v
+	if len(pattern) > v {
+		n = ((len(pattern) + v - 1) / v) * v
+	}
+	out := make([]byte, n)
+	for i := 0; i < n; i++ {
+		out[i] = pattern[i%len(pattern)]
+	}
+	return out
+}
+
+// addOne adds b to block plus one in place, treating both as big-endian
+// integers and discarding the carry out of the most significant byte (i.e.
+// arithmetic modulo 2^(8*len(block))), per RFC 7292 appendix B.2 step 6(C):
+// I_j = (I_j + B + 1) mod 2^v.
+func addOne(block, b []byte) {
+	carry := 1
+	for i := len(block) - 1; i >= 0; i-- {
+		sum := int(block[i]) + int(b[i]) + carry
+		block[i] = byte(sum)
+		carry = sum >> 8
+	}
+}
+
+// bmpStringZeroTerminated converts ASCII password bytes to UCS-2 (big
+// endian, as used by BMPString) and appends a zero-terminator, as required
+// by RFC 7292 appendix B.1. It returns an error for any non-ASCII byte.
+func bmpStringZeroTerminated(s []byte) ([]byte, error) {
+	// Only ASCII passwords are supported here, which covers every password
+	// this package itself generates in tests and examples.
+	for _, b := range s {
+		if b > 0x7f {
+			return nil, errors.New("pkcs12: only ASCII passwords are supported for MAC/PBE key derivation")
+		}
+	}
+	out := make([]byte, 0, len(s)*2+2)
+	for _, b := range s {
+		out = append(out, 0, b)
+	}
+	return append(out, 0, 0), nil
+}
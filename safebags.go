@@ -6,11 +6,13 @@
 package pkcs12
 
 import (
+	"crypto/ecdh"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"errors"
 	"io"
+	"strconv"
 )
 
 var (
@@ -46,7 +48,12 @@ func decodePkcs8ShroudedKeyBag(asn1Data, password []byte) (privateKey interface{
 		return nil, errors.New("pkcs12: error decoding PKCS#8 shrouded key bag: " + err.Error())
 	}
 
-	pkData, err := pbDecrypt(pkinfo, password)
+	var pkData []byte
+	if isPBES2(pkinfo.AlgorithmIdentifier) {
+		pkData, err = decryptPBES2(pkinfo.AlgorithmIdentifier, pkinfo.EncryptedData, password)
+	} else {
+		pkData, err = pbDecrypt(pkinfo, password)
+	}
 	if err != nil {
 		return nil, errors.New("pkcs12: error decrypting PKCS#8 shrouded key bag: " + err.Error())
 	}
@@ -56,6 +63,12 @@ func decodePkcs8ShroudedKeyBag(asn1Data, password []byte) (privateKey interface{
 		return nil, errors.New("pkcs12: error unmarshaling decrypted private key: " + err.Error())
 	}
 
+	if x25519Key, ok, err := parseX25519PrivateKey(pkData); err != nil {
+		return nil, errors.New("pkcs12: error parsing X25519 private key: " + err.Error())
+	} else if ok {
+		return x25519Key, nil
+	}
+
 	if privateKey, err = x509.ParsePKCS8PrivateKey(pkData); err != nil {
 		return nil, errors.New("pkcs12: error parsing PKCS#8 private key: " + err.Error())
 	}
@@ -63,27 +76,55 @@ func decodePkcs8ShroudedKeyBag(asn1Data, password []byte) (privateKey interface{
 	return privateKey, nil
 }
 
-func encodePkcs8ShroudedKeyBag(rand io.Reader, privateKey interface{}, password []byte) (asn1Data []byte, err error) {
-	var pkData []byte
-	if pkData, err = x509.MarshalPKCS8PrivateKey(privateKey); err != nil {
-		return nil, errors.New("pkcs12: error encoding PKCS#8 private key: " + err.Error())
+// encodePkcs8ShroudedKeyBag encrypts privateKey under password using opts,
+// returning the DER-encoded EncryptedPrivateKeyInfo. Passing the zero
+// EncryptOpts selects the legacy PBEWithSHAAnd3KeyTripleDESCBC scheme for
+// backwards compatibility; callers that want interoperable output with
+// OpenSSL 3 and modern Java keystores should pass DefaultEncryptOpts.
+// AESKeyWrap256 is not a valid choice here and returns an error rather than
+// silently falling back to a weaker scheme; it only applies to secretBag
+// contents added via EncodeBuilder.AddKEKWrappedSecret.
+func encodePkcs8ShroudedKeyBag(rand io.Reader, privateKey interface{}, password []byte, opts EncryptOpts) (asn1Data []byte, err error) {
+	switch opts.Algorithm {
+	case PBEWithSHAAnd3KeyTripleDESCBC, PBES2_AES256_SHA256, PBES2_AES256_GCM_SHA256:
+	default:
+		return nil, errors.New("pkcs12: EncryptOpts.Algorithm " + strconv.Itoa(int(opts.Algorithm)) + " is not valid for a shrouded key bag")
 	}
 
-	randomSalt := make([]byte, 8)
-	if _, err = rand.Read(randomSalt); err != nil {
-		return nil, errors.New("pkcs12: error reading random salt: " + err.Error())
-	}
-	var paramBytes []byte
-	if paramBytes, err = asn1.Marshal(pbeParams{Salt: randomSalt, Iterations: 2048}); err != nil {
-		return nil, errors.New("pkcs12: error encoding params: " + err.Error())
+	var pkData []byte
+	if x25519Key, ok := privateKey.(*ecdh.PrivateKey); ok {
+		if pkData, err = marshalX25519PrivateKey(x25519Key); err != nil {
+			return nil, errors.New("pkcs12: error encoding X25519 private key: " + err.Error())
+		}
+	} else if pkData, err = x509.MarshalPKCS8PrivateKey(privateKey); err != nil {
+		return nil, errors.New("pkcs12: error encoding PKCS#8 private key: " + err.Error())
 	}
 
 	var pkinfo encryptedPrivateKeyInfo
-	pkinfo.AlgorithmIdentifier.Algorithm = oidPBEWithSHAAnd3KeyTripleDESCBC
-	pkinfo.AlgorithmIdentifier.Parameters.FullBytes = paramBytes
 
-	if err = pbEncrypt(&pkinfo, pkData, password); err != nil {
-		return nil, errors.New("pkcs12: error encrypting PKCS#8 shrouded key bag: " + err.Error())
+	if isPBES2Algorithm(opts.Algorithm) {
+		alg, ciphertext, err := encryptPBES2(rand, pkData, password, opts)
+		if err != nil {
+			return nil, errors.New("pkcs12: error encrypting PKCS#8 shrouded key bag: " + err.Error())
+		}
+		pkinfo.AlgorithmIdentifier = alg
+		pkinfo.EncryptedData = ciphertext
+	} else {
+		randomSalt := make([]byte, 8)
+		if _, err = rand.Read(randomSalt); err != nil {
+			return nil, errors.New("pkcs12: error reading random salt: " + err.Error())
+		}
+		var paramBytes []byte
+		if paramBytes, err = asn1.Marshal(pbeParams{Salt: randomSalt, Iterations: 2048}); err != nil {
+			return nil, errors.New("pkcs12: error encoding params: " + err.Error())
+		}
+
+		pkinfo.AlgorithmIdentifier.Algorithm = oidPBEWithSHAAnd3KeyTripleDESCBC
+		pkinfo.AlgorithmIdentifier.Parameters.FullBytes = paramBytes
+
+		if err = pbEncrypt(&pkinfo, pkData, password); err != nil {
+			return nil, errors.New("pkcs12: error encrypting PKCS#8 shrouded key bag: " + err.Error())
+		}
 	}
 
 	if asn1Data, err = asn1.Marshal(pkinfo); err != nil {
@@ -99,6 +140,12 @@ func decodePkcs8KeyBag(asn1Data []byte) (privateKey interface{}, err error) {
 		return nil, errors.New("pkcs12: error unmarshaling private key: " + err.Error())
 	}
 
+	if x25519Key, ok, err := parseX25519PrivateKey(ret.Bytes); err != nil {
+		return nil, errors.New("pkcs12: error parsing X25519 private key: " + err.Error())
+	} else if ok {
+		return x25519Key, nil
+	}
+
 	if privateKey, err = x509.ParsePKCS8PrivateKey(ret.Bytes); err != nil {
 		return nil, errors.New("pkcs12: error parsing PKCS#8 private key: " + err.Error())
 	}
@@ -107,6 +154,10 @@ func decodePkcs8KeyBag(asn1Data []byte) (privateKey interface{}, err error) {
 }
 
 func encodePkcs8KeyBag(rand io.Reader, privateKey interface{}) (asn1Data []byte, err error) {
+	if x25519Key, ok := privateKey.(*ecdh.PrivateKey); ok {
+		return marshalX25519PrivateKey(x25519Key)
+	}
+
 	var pkData []byte
 	if pkData, err = x509.MarshalPKCS8PrivateKey(privateKey); err != nil {
 		return nil, errors.New("pkcs12: error encoding PKCS#8 private key: " + err.Error())
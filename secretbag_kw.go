@@ -0,0 +1,147 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+)
+
+// oidSecretBagAESKW marks a secretBag whose content-encryption key is
+// wrapped with a KEK via RFC 3394 AES Key Wrap, rather than derived from a
+// PKCS#12 password.
+var oidSecretBagAESKW = asn1.ObjectIdentifier([]int{1, 2, 840, 113549, 1, 9, 999, 2})
+
+// aesKWEncryptedContentInfo is the payload of an AES-KW-protected
+// secretBag: the wrapped content-encryption key, and the secret itself
+// encrypted under that key with AES-256-CBC.
+type aesKWEncryptedContentInfo struct {
+	WrappedKey       []byte
+	EncryptionScheme pkix.AlgorithmIdentifier
+	EncryptedContent []byte
+}
+
+// AddKEKWrappedSecret adds secretData as a secretBag whose content-
+// encryption key is wrapped with kek (a 16, 24 or 32-byte AES key) using
+// RFC 3394 AES Key Wrap, instead of a password-derived key. This is useful
+// for enterprise flows where the p12's secret is protected by a KEK held
+// separately from any PKCS#12 password.
+func (b *EncodeBuilder) AddKEKWrappedSecret(rand io.Reader, kek, secretData []byte, entry BagEntry) error {
+	attrs, err := bagAttributes(entry)
+	if err != nil {
+		return err
+	}
+
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return errors.New("pkcs12: error reading random content-encryption key: " + err.Error())
+	}
+	iv := make([]byte, 16)
+	if _, err := rand.Read(iv); err != nil {
+		return errors.New("pkcs12: error reading random IV: " + err.Error())
+	}
+
+	ciphertext, err := aesCBCEncrypt(cek, iv, secretData)
+	if err != nil {
+		return err
+	}
+
+	wrappedKey, err := aesKeyWrap(kek, cek)
+	if err != nil {
+		return err
+	}
+
+	ivBytes, err := asn1.Marshal(iv)
+	if err != nil {
+		return errors.New("pkcs12: error encoding AES-CBC IV: " + err.Error())
+	}
+
+	contentData, err := asn1.Marshal(aesKWEncryptedContentInfo{
+		WrappedKey:       wrappedKey,
+		EncryptionScheme: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivBytes}},
+		EncryptedContent: ciphertext,
+	})
+	if err != nil {
+		return errors.New("pkcs12: error encoding AES-KW secret bag: " + err.Error())
+	}
+
+	bagData, err := asn1.Marshal(secretBag{Id: oidSecretBagAESKW, Data: contentData})
+	if err != nil {
+		return errors.New("pkcs12: error encoding secret bag: " + err.Error())
+	}
+
+	b.secretBags = append(b.secretBags, safeBag{
+		Id:         oidSecretBag,
+		Value:      asn1.RawValue{Tag: 0, Class: asn1.ClassContextSpecific, IsCompound: true, Bytes: bagData},
+		Attributes: attrs,
+	})
+	return nil
+}
+
+// DecodeKEKWrappedSecret reverses AddKEKWrappedSecret: it unwraps the
+// secretBag's content-encryption key with kek and decrypts the secret. It
+// returns NotImplementedError if asn1Data is not an AES-KW secretBag (for
+// example a plain secretBag decoded via decodeSecretBag).
+func DecodeKEKWrappedSecret(asn1Data, kek []byte) (secretData []byte, err error) {
+	var bag secretBag
+	if err := unmarshal(asn1Data, &bag); err != nil {
+		return nil, errors.New("pkcs12: error decoding secret bag: " + err.Error())
+	}
+	if !bag.Id.Equal(oidSecretBagAESKW) {
+		return nil, NotImplementedError("secret bag is not KEK-wrapped with AES Key Wrap")
+	}
+
+	var content aesKWEncryptedContentInfo
+	if err := unmarshal(bag.Data, &content); err != nil {
+		return nil, errors.New("pkcs12: error decoding AES-KW secret bag: " + err.Error())
+	}
+	if !content.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, NotImplementedError("only AES-256-CBC is supported for AES-KW-wrapped secrets")
+	}
+
+	cek, err := aesKeyUnwrap(kek, content.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(content.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.New("pkcs12: error decoding AES-CBC IV: " + err.Error())
+	}
+
+	return aesCBCDecrypt(cek, iv, content.EncryptedContent)
+}
+
+// aesCBCEncrypt pads plaintext with PKCS#7 and encrypts it with AES-CBC
+// under key and iv.
+func aesCBCEncrypt(key, iv, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("pkcs12: error creating AES cipher: " + err.Error())
+	}
+	ciphertext := pkcs7Pad(plaintext, block.BlockSize())
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+	return ciphertext, nil
+}
+
+// aesCBCDecrypt decrypts ciphertext with AES-CBC under key and iv and
+// removes its PKCS#7 padding.
+func aesCBCDecrypt(key, iv, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("pkcs12: error creating AES cipher: " + err.Error())
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("pkcs12: ciphertext is not a multiple of the block size")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return pkcs7Unpad(plaintext, block.BlockSize())
+}
@@ -0,0 +1,77 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestKEKWrappedSecretRoundTrip(t *testing.T) {
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+	secretData := []byte("the quick brown fox")
+
+	builder := NewEncodeBuilder(rand.Reader, "changeit", DefaultEncryptOpts)
+	if err := builder.AddKEKWrappedSecret(rand.Reader, kek, secretData, BagEntry{FriendlyName: "kek-secret-1"}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	pfxData, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	blocks, err := ToPEM(pfxData, "changeit")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if len(blocks) != 1 {
+		t.Fatalf("got %d PEM blocks, want 1", len(blocks))
+	}
+	if blocks[0].Type != "SECRET BAG" {
+		t.Fatalf("block type = %q, want %q", blocks[0].Type, "SECRET BAG")
+	}
+
+	decoded, err := DecodeKEKWrappedSecret(blocks[0].Bytes, kek)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if !bytes.Equal(decoded, secretData) {
+		t.Fatal("decoded secret does not match original")
+	}
+}
+
+func TestKEKWrappedSecretWrongKEKFails(t *testing.T) {
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+
+	builder := NewEncodeBuilder(rand.Reader, "changeit", DefaultEncryptOpts)
+	if err := builder.AddKEKWrappedSecret(rand.Reader, kek, []byte("secret"), BagEntry{}); err != nil {
+		t.Fatalf("%+v", err)
+	}
+	pfxData, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	blocks, err := ToPEM(pfxData, "changeit")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+
+	wrongKek := make([]byte, 32)
+	if _, err := rand.Read(wrongKek); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeKEKWrappedSecret(blocks[0].Bytes, wrongKek); err == nil {
+		t.Fatal("expected error decoding with wrong KEK")
+	}
+}
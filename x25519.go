@@ -0,0 +1,73 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"crypto/ecdh"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+)
+
+// oidX25519 is the X25519 algorithm identifier from RFC 8410 section 3.
+// x509.MarshalPKCS8PrivateKey/ParsePKCS8PrivateKey do not support it (unlike
+// Ed25519, which they handle natively), so this package marshals and parses
+// the PKCS#8 PrivateKeyInfo for *ecdh.PrivateKey itself.
+var oidX25519 = asn1.ObjectIdentifier([]int{1, 3, 101, 110})
+
+// x25519PrivateKeyInfo mirrors the PrivateKeyInfo ASN.1 SEQUENCE (RFC 5208 section 5) that
+// x509 uses internally, reimplemented here because x509 has no public API
+// for encoding a raw X25519 key into that structure.
+type x25519PrivateKeyInfo struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// marshalX25519PrivateKey encodes key as a PKCS#8 PrivateKeyInfo, matching
+// the output x509.MarshalPKCS8PrivateKey would produce if it supported
+// X25519.
+func marshalX25519PrivateKey(key *ecdh.PrivateKey) ([]byte, error) {
+	if key.Curve() != ecdh.X25519() {
+		return nil, errors.New("pkcs12: only X25519 ecdh keys are supported")
+	}
+
+	curvePrivateKey, err := asn1.Marshal(key.Bytes())
+	if err != nil {
+		return nil, errors.New("pkcs12: error encoding X25519 private key: " + err.Error())
+	}
+
+	return asn1.Marshal(x25519PrivateKeyInfo{
+		Version:    0,
+		Algo:       pkix.AlgorithmIdentifier{Algorithm: oidX25519},
+		PrivateKey: curvePrivateKey,
+	})
+}
+
+// parseX25519PrivateKey decodes a PKCS#8 PrivateKeyInfo carrying an X25519
+// key, returning an *ecdh.PrivateKey. It returns ok == false (with a nil
+// error) if der does not describe an X25519 key, so callers can fall back
+// to x509.ParsePKCS8PrivateKey for other key types.
+func parseX25519PrivateKey(der []byte) (key *ecdh.PrivateKey, ok bool, err error) {
+	var pkinfo x25519PrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &pkinfo); err != nil {
+		return nil, false, nil
+	}
+	if !pkinfo.Algo.Algorithm.Equal(oidX25519) {
+		return nil, false, nil
+	}
+
+	var curvePrivateKey []byte
+	if _, err := asn1.Unmarshal(pkinfo.PrivateKey, &curvePrivateKey); err != nil {
+		return nil, true, errors.New("pkcs12: error decoding X25519 private key: " + err.Error())
+	}
+
+	key, err = ecdh.X25519().NewPrivateKey(curvePrivateKey)
+	if err != nil {
+		return nil, true, errors.New("pkcs12: invalid X25519 private key: " + err.Error())
+	}
+	return key, true, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2015, 2018, 2019 Opsmate, Inc. All rights reserved.
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pkcs12
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestEncodeDecodeRoundTripEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ed25519-test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Encode(rand.Reader, priv, cert, nil, "changeit")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	decodedKey, decodedCert, err := Decode(data, "changeit")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ed25519Key, ok := decodedKey.(ed25519.PrivateKey)
+	if !ok {
+		t.Fatalf("decoded key has type %T, want ed25519.PrivateKey", decodedKey)
+	}
+	if !ed25519Key.Equal(priv) {
+		t.Fatal("decoded Ed25519 key does not match original")
+	}
+	if !decodedCert.Equal(cert) {
+		t.Fatal("decoded certificate does not match original")
+	}
+}
+
+func TestEncodeDecodeRoundTripX25519(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := encodePkcs8ShroudedKeyBag(rand.Reader, key, []byte("changeit"), DefaultEncryptOpts)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	decodedKey, err := decodePkcs8ShroudedKeyBag(der, []byte("changeit"))
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	x25519Key, ok := decodedKey.(*ecdh.PrivateKey)
+	if !ok {
+		t.Fatalf("decoded key has type %T, want *ecdh.PrivateKey", decodedKey)
+	}
+	if !bytes.Equal(x25519Key.Bytes(), key.Bytes()) {
+		t.Fatal("decoded X25519 key does not match original")
+	}
+}
+
+// testEd25519P12 was produced against an OpenSSL 3-generated Ed25519 key and
+// self-signed certificate with:
+//
+//	openssl genpkey -algorithm ed25519 -out ed25519.key
+//	openssl req -new -x509 -key ed25519.key -out ed25519.crt -days 3650 -subj "/CN=ed25519-test"
+//	openssl pkcs12 -export -inkey ed25519.key -in ed25519.crt -out ed25519.p12 \
+//	    -passout pass:changeit -name ed25519-test
+//
+// It exercises the PBES2/AES-256-CBC shrouded key bag and HMAC-SHA256
+// MacData this package writes by default, produced independently by
+// OpenSSL rather than by this package's own encoder.
+const testEd25519P12 = `MIID0wIBAzCCA4kGCSqGSIb3DQEHAaCCA3oEggN2MIIDcjCCAlIGCSqGSIb3DQEHBqCCAkMwggI/
+AgEAMIICOAYJKoZIhvcNAQcBMFcGCSqGSIb3DQEFDTBKMCkGCSqGSIb3DQEFDDAcBAhRfbvVWFyr
+MgICCAAwDAYIKoZIhvcNAgkFADAdBglghkgBZQMEASoEEOZi/EeA2mJuXZjShBmRUBKAggHQ4jBs
+f7KDxjiaaH4oQ6+yVbOYJo4gdZ/1TXbGgieYXIBZeLgEmXfjdFsgjGH34W15ZanDmb5H/99hlyKB
+1zREsRQAGJ8hBrvTh8QUzvXHE+Ojru1mUbdsCrzt0uvBh+iuQhsj0TxMU7M7VaZ880fMbHyiClzf
+3HnW8dna0cOngPF8wwVgEJZQzXKn6A0kAmNzeIoqWCUVMD4KePyMIiR3BypGg5SJtCN6ST8HSPWc
+T5ynipF/uz+20oZdcBrGzlXo9Jx7J8vdozjJlXBlVO6quxhVOhpdg89fI4xkMYaigc903LMraXcK
+q+IhY1ZibgF/6eO8K4crDZ+Cnr8IuVXoD80IoPdGydwOBqAql9UTodE5Ip4WI2nRvzMYjTvWIKZh
+HyyHplCuNC7rLYdlkI5Z5vrsbXMM6S8oW9x4rZkFGW4VMGIRGLoQNCMXWwPhxI0b/6t9OWBNEjBe
+n+JrEe875VL4u0XqrdglvQjKb+NrTXM7yo4vIeIZfpmOUbrT9d54urnYzlIc30w4JUO17fy17Vv5
+TI4Ud2zLgO6mCd0b+4cUGYFSZCgIw58PdL8qorE46SUEImz1V21IA3tCP243k/5EH3eMr2t1jFdc
+Fw0JELIwggEYBgkqhkiG9w0BBwGgggEJBIIBBTCCAQEwgf4GCyqGSIb3DQEMCgECoIGeMIGbMFcG
+CSqGSIb3DQEFDTBKMCkGCSqGSIb3DQEFDDAcBAgU9seiTEondgICCAAwDAYIKoZIhvcNAgkFADAd
+BglghkgBZQMEASoEEAMxGSorlrD1BkSBjOWhtmoEQG0dDdogYeMyE8qA2Q037QTILrp4X3VDHtau
+UAJOpgtis0v0NU4DKf7xdMB7rTjIBYe54TtbicB7e8dymW7mxSAxTjAjBgkqhkiG9w0BCRUxFgQU
+C8z1N6TlxOqGWj075vLhesNPLgAwJwYJKoZIhvcNAQkUMRoeGABlAGQAMgA1ADUAMQA5AC0AdABl
+AHMAdDBBMDEwDQYJYIZIAWUDBAIBBQAEIFLCGeHtmlsmndDkyUjFFRQbLzDFigU0Pj/zAvMkgTwR
+BAhf7HJNmtGH6gICCAA=`
+
+func TestDecodeEd25519OpenSSLFixture(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testEd25519P12)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, cert, err := Decode(data, "changeit")
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if _, ok := key.(ed25519.PrivateKey); !ok {
+		t.Fatalf("decoded key has type %T, want ed25519.PrivateKey", key)
+	}
+	if cert.Subject.CommonName != "ed25519-test" {
+		t.Fatalf("certificate CommonName = %q, want %q", cert.Subject.CommonName, "ed25519-test")
+	}
+}